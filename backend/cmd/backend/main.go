@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -21,12 +25,16 @@ import (
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	otgrpc "github.com/opentracing-contrib/go-grpc"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uber/jaeger-client-go/config"
 	cli "github.com/urfave/cli/v2"
 	dinghy "gitlab.com/davedamoon/dinghy/backend/pkg"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/client"
 	"gitlab.com/davedamoon/dinghy/backend/pkg/middleware"
 	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
 	"google.golang.org/grpc"
+	grpc_credentials "google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -55,9 +63,61 @@ func main() {
 					&cli.StringFlag{Name: "s3-bucket", Required: true, Usage: "s3 bucket name."},
 					&cli.StringFlag{Name: "frontend-url", Required: true, Usage: "Frontend domain for CORS and redirects."},
 					&cli.StringFlag{Name: "notify-endpoint", Value: "notify:50051", Usage: "Notify service endpoint."},
+					&cli.DurationFlag{Name: "relist-interval", Value: 500 * time.Millisecond, Usage: "Minimal time between two listings sent to a client watching a directory, changes in between are merged."},
+					&cli.StringFlag{Name: "tls-cert-file", Usage: "Path to pem certificate serving the service and admin listeners with TLS, reloaded on change."},
+					&cli.StringFlag{Name: "tls-key-file", Usage: "Path to pem key of the certificate."},
+					&cli.DurationFlag{Name: "notify-poll-interval", Value: 10 * time.Second, Usage: "Interval watched directories are polled at while the notify service is unavailable."},
+					&cli.BoolFlag{Name: "notify-tls", Usage: "Connect to the notify service with TLS."},
+					&cli.StringFlag{Name: "notify-ca-file", Usage: "Path to pem CA verifying the notify service instead of the system roots."},
+					&cli.StringFlag{Name: "notify-cert-file", Usage: "Path to pem client certificate for mutual TLS with the notify service."},
+					&cli.StringFlag{Name: "notify-key-file", Usage: "Path to pem key of the client certificate."},
+					&cli.StringFlag{Name: "notify-server-name", Usage: "Name expected in the certificate of the notify service, defaults to the host of the endpoint."},
+					&cli.StringFlag{Name: "auth-token-file", Usage: "Path to static bearer tokens (token user [groups] per line)."},
+					&cli.StringFlag{Name: "auth-htpasswd-file", Usage: "Path to htpasswd file for basic auth."},
+					&cli.StringFlag{Name: "oidc-issuer", Usage: "OpenID Connect issuer url, enables login via OIDC."},
+					&cli.StringFlag{Name: "oidc-client-id", Usage: "OpenID Connect client id."},
+					&cli.StringFlag{Name: "oidc-client-secret-file", Usage: "Path to OpenID Connect client secret."},
+					&cli.StringFlag{Name: "oidc-redirect-url", Usage: "OpenID Connect callback url, e.g. https://backend/auth/callback."},
+					&cli.StringSliceFlag{Name: "oidc-scopes", Value: cli.NewStringSlice("profile", "email"), Usage: "OpenID Connect scopes."},
+					&cli.StringFlag{Name: "oidc-user-claim", Value: "sub", Usage: "Claim naming a user, email is only accepted if verified."},
+					&cli.StringFlag{Name: "oidc-groups-claim", Value: "groups", Usage: "Claim listing the groups of a user."},
+					&cli.StringFlag{Name: "session-key-file", Usage: "Path to key (32+ bytes) signing session cookies."},
+					&cli.DurationFlag{Name: "session-ttl", Value: 12 * time.Hour, Usage: "Lifetime of login sessions."},
+					&cli.StringFlag{Name: "policy-file", Usage: "Path to json policy granting users permissions on paths."},
+					&cli.StringFlag{Name: "upload-policy-file", Usage: "Path to json policy limiting size, type and name of uploads."},
+					&cli.StringFlag{Name: "clamd-address", Usage: "Address of clamd scanning uploads for viruses, like tcp://localhost:3310 or unix:///run/clamd.sock."},
+					&cli.DurationFlag{Name: "clamd-timeout", Value: 5 * time.Minute, Usage: "Time limit to scan a single file."},
+					&cli.BoolFlag{Name: "block-unscanned", Usage: "Refuse downloads of files which have not been scanned clean."},
+					&cli.StringFlag{Name: "rate-limit-file", Usage: "Path to json rate and concurrency limits per client for list, download, upload, thumbnail and websocket requests, and per ip for all requests before authentication."},
+					&cli.BoolFlag{Name: "trust-proxy", Usage: "Identify clients by the X-Forwarded-For header set by a reverse proxy."},
+					&cli.StringFlag{Name: "audit-log", Usage: "Destination of the audit log of all changes: stdout, bucket or a file path."},
+					&cli.StringFlag{Name: "audit-token-file", Usage: "Path to bearer tokens allowed to query the audit log on the admin server (token user per line)."},
+					&cli.StringFlag{Name: "usercontent-url", Usage: "Separate origin like https://usercontent.example.com rendering uploaded html, it has to reach the service server."},
+					&cli.StringFlag{Name: "usercontent-key-file", Usage: "Path to key (32+ bytes) signing user content urls, random if unset."},
+					&cli.DurationFlag{Name: "usercontent-ttl", Value: time.Hour, Usage: "Lifetime of user content urls."},
+					&cli.StringFlag{Name: "share-key-file", Usage: "Path to key (32+ bytes) signing share links, enables sharing."},
+					&cli.DurationFlag{Name: "share-max-ttl", Value: 30 * 24 * time.Hour, Usage: "Maximal lifetime of share links."},
 				},
 				Action: run,
 			},
+			{
+				Name:      "sync",
+				Usage:     "Mirror a local directory to a dinghy directory or vice versa.",
+				ArgsUsage: "<source> <target>",
+				Description: "Either source or target is a local directory, the other one is the url of a dinghy directory.\n" +
+					"Example: backend sync ./photos http://localhost:8080/photos/",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "delete", Usage: "Delete files from the target missing in the source."},
+					&cli.BoolFlag{Name: "dry-run", Usage: "Only print the changes."},
+					&cli.IntFlag{Name: "parallel", Value: 4, Usage: "Number of concurrent transfers."},
+					&cli.BoolFlag{Name: "watch", Usage: "Keep synchronising until interrupted."},
+					&cli.DurationFlag{Name: "interval", Value: time.Minute, Usage: "Interval for full passes in watch mode."},
+					&cli.StringFlag{Name: "token-file", EnvVars: []string{"DINGHY_TOKEN_FILE"}, Usage: "Path to bearer token for authentication."},
+					&cli.StringFlag{Name: "username", EnvVars: []string{"DINGHY_USERNAME"}, Usage: "Username for basic authentication."},
+					&cli.StringFlag{Name: "password", EnvVars: []string{"DINGHY_PASSWORD"}, Usage: "Password for basic authentication."},
+				},
+				Action: runSync,
+			},
 			{
 				Name:  "version",
 				Usage: "Show the version",
@@ -88,6 +148,16 @@ func run(c *cli.Context) error {
 
 	middleware.InitMetrics(gitHash, gitRef)
 
+	err := dinghy.RegisterMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		return fmt.Errorf("register metrics: %v", err)
+	}
+
+	err = auth.RegisterMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		return fmt.Errorf("register metrics: %v", err)
+	}
+
 	log.Println("set up tracing")
 
 	jaeger, err := setupJaeger()
@@ -111,40 +181,180 @@ func run(c *cli.Context) error {
 
 	log.Println("set up notify client")
 
-	nc, closeNotify, err := setupNotifyClient(c.String("notify-endpoint"))
+	notifyCreds := insecure.NewCredentials()
+	if c.Bool("notify-tls") {
+		serverName := c.String("notify-server-name")
+		if serverName == "" {
+			serverName, _, err = net.SplitHostPort(c.String("notify-endpoint"))
+			if err != nil {
+				return fmt.Errorf("notify endpoint %s: %v", c.String("notify-endpoint"), err)
+			}
+		}
+
+		cfg, err := middleware.ClientTLSConfig(
+			c.String("notify-ca-file"),
+			c.String("notify-cert-file"),
+			c.String("notify-key-file"),
+			serverName)
+		if err != nil {
+			return fmt.Errorf("setup notify tls: %v", err)
+		}
+		notifyCreds = grpc_credentials.NewTLS(cfg)
+	}
+
+	nc, closeNotify, err := setupNotifyClient(c.String("notify-endpoint"), notifyCreds)
 	if err != nil {
 		return fmt.Errorf("setup notify client: %v", err)
 	}
 	defer closeNotify.Close()
 
+	nc.PollInterval = c.Duration("notify-poll-interval")
+
+	log.Println("set up authentication")
+
+	authenticators, oidc, err := setupAuthentication(c)
+	if err != nil {
+		return fmt.Errorf("setup authentication: %v", err)
+	}
+
+	var policy *dinghy.Policy
+	if c.String("policy-file") != "" {
+		policy, err = dinghy.LoadPolicy(c.String("policy-file"))
+		if err != nil {
+			return fmt.Errorf("setup authorization: %v", err)
+		}
+	}
+
+	var uploads *dinghy.UploadPolicy
+	if c.String("upload-policy-file") != "" {
+		uploads, err = dinghy.LoadUploadPolicy(c.String("upload-policy-file"))
+		if err != nil {
+			return fmt.Errorf("setup upload policy: %v", err)
+		}
+	}
+
+	var scanner *dinghy.Scanner
+	if c.String("clamd-address") != "" {
+		scanner, err = dinghy.NewScanner(c.String("clamd-address"), c.Duration("clamd-timeout"))
+		if err != nil {
+			return fmt.Errorf("setup virus scanner: %v", err)
+		}
+	}
+
+	var limiter *auth.RateLimiter
+	if c.String("rate-limit-file") != "" {
+		limits, err := auth.LoadRateLimits(c.String("rate-limit-file"))
+		if err != nil {
+			return fmt.Errorf("setup rate limits: %v", err)
+		}
+
+		limiter = auth.NewRateLimiter(limits, c.Bool("trust-proxy"))
+	}
+
+	var shares *dinghy.Shares
+	if c.String("share-key-file") != "" {
+		key, err := os.ReadFile(c.String("share-key-file"))
+		if err != nil {
+			return fmt.Errorf("reading share key from %s: %v", c.String("share-key-file"), err)
+		}
+
+		if len(key) < 32 {
+			return fmt.Errorf("share key needs at least 32 bytes")
+		}
+
+		shares = &dinghy.Shares{
+			Key:    key,
+			MaxTTL: c.Duration("share-max-ttl"),
+		}
+	}
+
+	userContent, err := setupUserContent(c)
+	if err != nil {
+		return fmt.Errorf("setup user content: %v", err)
+	}
+
+	var audit *dinghy.AuditLog
+	if c.String("audit-log") != "" {
+		audit, err = dinghy.NewAuditLog(c.String("audit-log"), storage)
+		if err != nil {
+			return fmt.Errorf("setup audit log: %v", err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if c.String("tls-cert-file") != "" || c.String("tls-key-file") != "" {
+		tlsConfig, err = middleware.ServerTLSConfig(c.String("tls-cert-file"), c.String("tls-key-file"), "")
+		if err != nil {
+			return fmt.Errorf("setup tls: %v", err)
+		}
+	}
+
 	log.Println("set up servers")
 
 	adm := dinghy.NewAdminServer()
+	adm.Audit = audit
+	if c.String("audit-token-file") != "" {
+		tokens, err := auth.LoadBearerTokens(c.String("audit-token-file"))
+		if err != nil {
+			return fmt.Errorf("setup audit authentication: %v", err)
+		}
+		adm.AuditAuthenticators = []auth.Authenticator{tokens}
+	}
+	adm.Degraded = func() error {
+		if !nc.Available() {
+			return fmt.Errorf("notify unavailable, polling watched directories")
+		}
+
+		return nil
+	}
 	admHandler := middleware.RequestID(rand.Int63, adm)
 	admHandler = middleware.InitTraceContext(admHandler)
 	//admHandler = dinghy.InstrumentHttpHandler(admHandler) // reduce noise
-	admHandler = middleware.Timeout(900*time.Millisecond, admHandler)
-	admServer := httpServer(admHandler, c.String("admin-addr"))
+	// audit queries read the whole log
+	admHandler = middleware.Timeout(30*time.Second, admHandler)
+	admServer := httpServer(admHandler, c.String("admin-addr"), tlsConfig)
 
-	svc := &dinghy.ServiceServer{}
+	svc := dinghy.NewServiceServer()
 	svc.FrontendURL = c.String("frontend-url")
 	svc.Storage = storage
 	svc.Notify = nc
+	svc.Policy = policy
+	svc.Uploads = uploads
+	svc.Scanner = scanner
+	svc.BlockUnscanned = c.Bool("block-unscanned")
+	svc.Shares = shares
+	svc.Limiter = limiter
+	svc.Audit = audit
+	svc.UserContent = userContent
+	svc.TrustProxy = c.Bool("trust-proxy")
+	svc.RelistInterval = c.Duration("relist-interval")
 	svc.Upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
-			return r.Header.Get("Origin") == c.String("frontend-url")
+			// non browser clients like the sync command do not send an origin
+			origin := r.Header.Get("Origin")
+			return origin == "" || origin == c.String("frontend-url")
 		},
 	}
 
-	svcHandler := middleware.CORS(c.String("frontend-url"), svc)
+	var svcHandler http.Handler = svc
+	if limiter != nil {
+		svcHandler = auth.RateLimit(limiter, svcHandler)
+	}
+	if len(authenticators) > 0 {
+		svcHandler = auth.Authenticate(authenticators, oidc, svc.IsPublic, svcHandler)
+	}
+	if limiter != nil {
+		svcHandler = auth.RateLimitIP(limiter, svcHandler)
+	}
+	svcHandler = middleware.CORS(c.String("frontend-url"), svcHandler)
 	svcHandler = middleware.RequestID(rand.Int63, svcHandler)
 	svcHandler = middleware.InitTraceContext(svcHandler)
 	svcHandler = middleware.InstrumentHttpHandler(svcHandler)
 	svcHandler = middleware.Timeout(10*time.Minute, svcHandler)
 
-	svcServer := httpServer(svcHandler, c.String("service-addr"))
+	svcServer := httpServer(svcHandler, c.String("service-addr"), tlsConfig)
 
 	log.Println("starting admin server")
 
@@ -171,17 +381,176 @@ func run(c *cli.Context) error {
 		return fmt.Errorf("shutdown admin server: %v", err)
 	}
 
+	err = audit.Close()
+	if err != nil {
+		return fmt.Errorf("close audit log: %v", err)
+	}
+
 	log.Println("shutdown complete")
 
 	return nil
 }
 
-func setupNotifyClient(addr string) (*dinghy.NotifyAdapter, io.Closer, error) {
+func setupUserContent(c *cli.Context) (*dinghy.UserContent, error) {
+	if c.String("usercontent-url") == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(c.String("usercontent-url"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("usercontent url %s needs to be absolute", c.String("usercontent-url"))
+	}
+
+	frontend, err := url.Parse(c.String("frontend-url"))
+	if err == nil && strings.EqualFold(frontend.Host, u.Host) {
+		return nil, fmt.Errorf("usercontent url needs another host than the frontend")
+	}
+
+	key := make([]byte, 32)
+	if c.String("usercontent-key-file") != "" {
+		key, err = os.ReadFile(c.String("usercontent-key-file"))
+		if err != nil {
+			return nil, fmt.Errorf("reading usercontent key from %s: %v", c.String("usercontent-key-file"), err)
+		}
+
+		if len(key) < 32 {
+			return nil, fmt.Errorf("usercontent key needs at least 32 bytes")
+		}
+	} else {
+		log.Println("no usercontent key set, user content urls are only valid for this instance")
+
+		_, err = crand.Read(key)
+		if err != nil {
+			return nil, fmt.Errorf("generate usercontent key: %v", err)
+		}
+	}
+
+	return &dinghy.UserContent{
+		URL: u,
+		Key: key,
+		TTL: c.Duration("usercontent-ttl"),
+	}, nil
+}
+
+func runSync(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("expected source and target, got %d arguments", c.NArg())
+	}
+
+	src, dst := c.Args().Get(0), c.Args().Get(1)
+
+	upload := isURL(dst)
+	if upload == isURL(src) {
+		return fmt.Errorf("exactly one of source and target needs to be a url")
+	}
+
+	local, remote := src, dst
+	if !upload {
+		local, remote = dst, src
+	}
+
+	cl, err := client.New(remote)
+	if err != nil {
+		return err
+	}
+
+	cl.Username = c.String("username")
+	cl.Password = c.String("password")
+
+	if c.String("token-file") != "" {
+		token, err := os.ReadFile(c.String("token-file"))
+		if err != nil {
+			return fmt.Errorf("reading token from %s: %v", c.String("token-file"), err)
+		}
+		cl.Token = strings.TrimSpace(string(token))
+	}
+
+	remotePath := "/" + strings.Trim(cl.Endpoint.Path, "/") + "/"
+	remotePath = strings.ReplaceAll(remotePath, "//", "/")
+	cl.Endpoint.Path = ""
+
+	s := &client.Sync{
+		Client:   cl,
+		Local:    local,
+		Remote:   remotePath,
+		Upload:   upload,
+		Delete:   c.Bool("delete"),
+		DryRun:   c.Bool("dry-run"),
+		Parallel: c.Int("parallel"),
+		Out:      os.Stdout,
+	}
+
+	ctx, cancel := signal.NotifyContext(c.Context, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if c.Bool("watch") {
+		return s.Watch(ctx, c.Duration("interval"))
+	}
+
+	return s.Run(ctx)
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func setupAuthentication(c *cli.Context) ([]auth.Authenticator, *auth.OIDC, error) {
+	authenticators := []auth.Authenticator{}
+
+	if c.String("auth-token-file") != "" {
+		tokens, err := auth.LoadBearerTokens(c.String("auth-token-file"))
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticators = append(authenticators, tokens)
+	}
+
+	if c.String("auth-htpasswd-file") != "" {
+		htpasswd, err := auth.LoadHtpasswd(c.String("auth-htpasswd-file"))
+		if err != nil {
+			return nil, nil, err
+		}
+		authenticators = append(authenticators, htpasswd)
+	}
+
+	if c.String("oidc-issuer") == "" {
+		return authenticators, nil, nil
+	}
+
+	secret, err := os.ReadFile(c.String("oidc-client-secret-file"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading oidc client secret from %s: %v", c.String("oidc-client-secret-file"), err)
+	}
+
+	sessionKey, err := os.ReadFile(c.String("session-key-file"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading session key from %s: %v", c.String("session-key-file"), err)
+	}
+
+	oidc, err := auth.NewOIDC(
+		c.Context,
+		c.String("oidc-issuer"),
+		c.String("oidc-client-id"),
+		strings.TrimSpace(string(secret)),
+		c.String("oidc-redirect-url"),
+		c.StringSlice("oidc-scopes"),
+		c.String("oidc-user-claim"),
+		c.String("oidc-groups-claim"),
+		sessionKey,
+		c.Duration("session-ttl"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(authenticators, oidc), oidc, nil
+}
+
+func setupNotifyClient(addr string, creds grpc_credentials.TransportCredentials) (*dinghy.NotifyAdapter, io.Closer, error) {
 	tracer := opentracing.GlobalTracer()
 
 	conn, err := grpc.Dial(
 		addr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithTransportCredentials(creds),
 		grpc.WithUnaryInterceptor(grpc_prometheus.UnaryClientInterceptor),
 		grpc.WithUnaryInterceptor(otgrpc.OpenTracingClientInterceptor(tracer)),
 		grpc.WithStreamInterceptor(grpc_prometheus.StreamClientInterceptor),
@@ -252,10 +621,11 @@ func setupJaeger() (io.Closer, error) {
 	return closer, nil
 }
 
-func httpServer(h http.Handler, addr string) *http.Server {
+func httpServer(h http.Handler, addr string, tlsConfig *tls.Config) *http.Server {
 	httpServer := &http.Server{
 		ReadTimeout:  10 * time.Minute,
 		WriteTimeout: 10 * time.Minute,
+		TLSConfig:    tlsConfig,
 	}
 	httpServer.Addr = addr
 	httpServer.Handler = h
@@ -264,7 +634,13 @@ func httpServer(h http.Handler, addr string) *http.Server {
 }
 
 func mustListenAndServe(srv *http.Server) {
-	err := srv.ListenAndServe()
+	var err error
+	if srv.TLSConfig != nil {
+		// the certificate is provided by the tls config
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
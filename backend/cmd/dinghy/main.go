@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/client"
+)
+
+var (
+	gitHash string
+	gitRef  string
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	err := newApp().RunContext(ctx, os.Args)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+func newApp() *cli.App {
+	recursive := &cli.BoolFlag{Name: "recursive", Aliases: []string{"r"}, Usage: "Include subdirectories."}
+
+	return &cli.App{
+		Name:  "dinghy",
+		Usage: "Command line client for the dinghy http api.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "endpoint", Value: "http://localhost:8080", EnvVars: []string{"DINGHY_ENDPOINT"}, Usage: "Url of the dinghy backend."},
+			&cli.StringFlag{Name: "token", EnvVars: []string{"DINGHY_TOKEN"}, Usage: "Bearer token for authentication."},
+			&cli.StringFlag{Name: "token-file", EnvVars: []string{"DINGHY_TOKEN_FILE"}, Usage: "Path to bearer token for authentication."},
+			&cli.StringFlag{Name: "username", EnvVars: []string{"DINGHY_USERNAME"}, Usage: "Username for basic authentication."},
+			&cli.StringFlag{Name: "password", EnvVars: []string{"DINGHY_PASSWORD"}, Usage: "Password for basic authentication."},
+			&cli.BoolFlag{Name: "json", Usage: "Print machine readable json lines."},
+			&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "Hide progress bars."},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "ls",
+				Usage:     "List a directory.",
+				ArgsUsage: "<path>",
+				Flags:     []cli.Flag{recursive},
+				Action:    ls,
+			},
+			{
+				Name:      "get",
+				Usage:     "Download a file or directory.",
+				ArgsUsage: "<path> [local path]",
+				Flags:     []cli.Flag{recursive},
+				Action:    get,
+			},
+			{
+				Name:      "put",
+				Usage:     "Upload a file or directory.",
+				ArgsUsage: "<local path> <path>",
+				Flags:     []cli.Flag{recursive},
+				Action:    put,
+			},
+			{
+				Name:      "rm",
+				Usage:     "Remove a file or directory.",
+				ArgsUsage: "<path>",
+				Flags:     []cli.Flag{recursive},
+				Action:    rm,
+			},
+			{
+				Name:      "cp",
+				Usage:     "Copy a file or directory.",
+				ArgsUsage: "<path> <path>",
+				Flags:     []cli.Flag{recursive},
+				Action:    cp,
+			},
+			{
+				Name:      "mv",
+				Usage:     "Move a file or directory.",
+				ArgsUsage: "<path> <path>",
+				Flags:     []cli.Flag{recursive},
+				Action:    mv,
+			},
+			{
+				Name:      "extract",
+				Usage:     "Extract an archive next to it.",
+				ArgsUsage: "<path>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{Name: "timeout", Value: 30 * time.Minute, Usage: "Time to wait for the extraction to finish."},
+				},
+				Action: extract,
+			},
+			{
+				Name:  "share",
+				Usage: "Manage share links.",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "create",
+						Usage:     "Create a link to a file or directory.",
+						ArgsUsage: "<path>",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{Name: "expires-in", Usage: "Lifetime of the link."},
+							&cli.StringFlag{Name: "password", Usage: "Password protecting the link."},
+							&cli.IntFlag{Name: "max-downloads", Usage: "Number of downloads before the link is deleted."},
+						},
+						Action: shareCreate,
+					},
+					{
+						Name:   "ls",
+						Usage:  "List active links.",
+						Action: shareList,
+					},
+					{
+						Name:      "revoke",
+						Usage:     "Delete a link.",
+						ArgsUsage: "<token>",
+						Action:    shareRevoke,
+					},
+				},
+			},
+			{
+				Name:  "version",
+				Usage: "Show the version",
+				Action: func(c *cli.Context) error {
+					_, err := os.Stdout.WriteString(fmt.Sprintf("version: %s\ngit commit: %s", gitRef, gitHash))
+					if err != nil {
+						return err
+					}
+
+					return nil
+				},
+			},
+		},
+	}
+}
+
+type result struct {
+	Op     string `json:"op"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+func newClient(c *cli.Context) (*client.Client, error) {
+	cl, err := client.New(c.String("endpoint"))
+	if err != nil {
+		return nil, err
+	}
+
+	cl.Token = c.String("token")
+	cl.Username = c.String("username")
+	cl.Password = c.String("password")
+
+	if c.String("token-file") != "" {
+		token, err := os.ReadFile(c.String("token-file"))
+		if err != nil {
+			return nil, fmt.Errorf("reading token from %s: %v", c.String("token-file"), err)
+		}
+		cl.Token = strings.TrimSpace(string(token))
+	}
+
+	return cl, nil
+}
+
+func args(c *cli.Context, min, max int) ([]string, error) {
+	if c.NArg() < min || c.NArg() > max {
+		return nil, fmt.Errorf("%s: wrong number of arguments, expected %s", c.Command.Name, c.Command.ArgsUsage)
+	}
+
+	return c.Args().Slice(), nil
+}
+
+func remotePath(path string) string {
+	return "/" + strings.TrimPrefix(path, "/")
+}
+
+func report(c *cli.Context, r result) error {
+	if c.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+
+	switch {
+	case r.URL != "":
+		fmt.Println(r.URL)
+	case r.Target != "":
+		fmt.Printf("%s %s -> %s\n", r.Op, r.Source, r.Target)
+	default:
+		fmt.Printf("%s %s\n", r.Op, r.Source)
+	}
+
+	return nil
+}
+
+func ls(c *cli.Context) error {
+	a, err := args(c, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	path := "/"
+	if len(a) == 1 {
+		path = remotePath(a[0])
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	show := func(d client.Directory) error {
+		if c.Bool("json") {
+			return json.NewEncoder(os.Stdout).Encode(d)
+		}
+
+		for _, dir := range d.Directories {
+			fmt.Printf("%s%s/\n", remotePath(d.Path), dir)
+		}
+		for _, f := range d.Files {
+			fmt.Printf("%s\t%s\n", f.Path, humanBytes(f.Size))
+		}
+
+		return nil
+	}
+
+	if c.Bool("recursive") {
+		return cl.Walk(c.Context, path, show)
+	}
+
+	d, err := cl.List(c.Context, path)
+	if err != nil {
+		return err
+	}
+
+	return show(d)
+}
+
+// files lists all files below a directory, or the file itself.
+func files(c *cli.Context, cl *client.Client, path string) ([]client.File, error) {
+	if !c.Bool("recursive") {
+		return []client.File{{Path: path, Name: filepath.Base(path)}}, nil
+	}
+
+	dir := strings.TrimSuffix(path, "/") + "/"
+	found := []client.File{}
+
+	err := cl.Walk(c.Context, dir, func(d client.Directory) error {
+		found = append(found, d.Files...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func get(c *cli.Context) error {
+	a, err := args(c, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	src := remotePath(a[0])
+	dst := "."
+	if len(a) == 2 {
+		dst = a[1]
+	}
+
+	fl, err := files(c, cl, src)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(src, "/")
+	base = base[:strings.LastIndex(base, "/")+1]
+
+	for _, f := range fl {
+		target := dst
+		info, err := os.Stat(dst)
+		if c.Bool("recursive") || (err == nil && info.IsDir()) {
+			target = filepath.Join(dst, filepath.FromSlash(strings.TrimPrefix(f.Path, base)))
+		}
+
+		err = download(c, cl, f, target)
+		if err != nil {
+			return err
+		}
+
+		err = report(c, result{Op: "get", Source: f.Path, Target: target, Size: f.Size})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// download writes the file to a temporary file next to target first,
+// so that a failed download leaves an existing file untouched.
+func download(c *cli.Context, cl *client.Client, f client.File, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(target), ".dinghy-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	bar := newProgress(c, f.Path, f.Size)
+	defer bar.done()
+
+	err = cl.Download(c.Context, f.Path, io.MultiWriter(out, bar))
+	if err != nil {
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), target)
+}
+
+func put(c *cli.Context) error {
+	a, err := args(c, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	src, dst := a[0], remotePath(a[1])
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		if strings.HasSuffix(dst, "/") {
+			dst += filepath.Base(src)
+		}
+		return upload(c, cl, src, dst)
+	}
+
+	if !c.Bool("recursive") {
+		return fmt.Errorf("%s is a directory, use --recursive", src)
+	}
+
+	dst = strings.TrimSuffix(dst, "/") + "/" + filepath.Base(filepath.Clean(src)) + "/"
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		return upload(c, cl, path, dst+filepath.ToSlash(rel))
+	})
+}
+
+func upload(c *cli.Context, cl *client.Client, src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	bar := newProgress(c, dst, info.Size())
+	defer bar.done()
+
+	contentType := mime.TypeByExtension(filepath.Ext(src))
+
+	err = cl.Upload(c.Context, dst, io.TeeReader(f, bar), info.Size(), contentType)
+	if err != nil {
+		return err
+	}
+
+	return report(c, result{Op: "put", Source: src, Target: dst, Size: info.Size()})
+}
+
+func rm(c *cli.Context) error {
+	a, err := args(c, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	path := remotePath(a[0])
+
+	if c.Bool("recursive") {
+		if path == "/" {
+			return fmt.Errorf("refusing to remove the root directory")
+		}
+
+		err = cl.RemoveRecursive(c.Context, strings.TrimSuffix(path, "/")+"/")
+	} else {
+		err = cl.Delete(c.Context, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return report(c, result{Op: "rm", Source: path})
+}
+
+func cp(c *cli.Context) error {
+	return copyFiles(c, "cp", false)
+}
+
+func mv(c *cli.Context) error {
+	return copyFiles(c, "mv", true)
+}
+
+func copyFiles(c *cli.Context, op string, remove bool) error {
+	a, err := args(c, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	src, dst := remotePath(a[0]), remotePath(a[1])
+
+	fl, err := files(c, cl, src)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fl {
+		target := dst
+		switch {
+		case c.Bool("recursive"):
+			target = strings.TrimSuffix(dst, "/") + "/" + strings.TrimPrefix(f.Path, strings.TrimSuffix(src, "/")+"/")
+		case strings.HasSuffix(dst, "/"):
+			target = dst + f.Name
+		}
+
+		err = copyFile(c, cl, f, target)
+		if err != nil {
+			return err
+		}
+
+		if remove {
+			err = cl.Delete(c.Context, f.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = report(c, result{Op: op, Source: f.Path, Target: target, Size: f.Size})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile transfers the file through a temporary local file,
+// the http api offers no server side copy.
+func copyFile(c *cli.Context, cl *client.Client, f client.File, target string) error {
+	tmp, err := os.CreateTemp("", "dinghy_copy")
+	if err != nil {
+		return fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = cl.Download(c.Context, f.Path, tmp)
+	if err != nil {
+		return err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("seek temp file: %v", err)
+	}
+
+	bar := newProgress(c, target, info.Size())
+	defer bar.done()
+
+	contentType := mime.TypeByExtension(filepath.Ext(target))
+
+	return cl.Upload(c.Context, target, io.TeeReader(tmp, bar), info.Size(), contentType)
+}
+
+func extract(c *cli.Context) error {
+	a, err := args(c, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	path := remotePath(a[0])
+
+	ctx, cancel := context.WithTimeout(c.Context, c.Duration("timeout"))
+	defer cancel()
+
+	err = cl.Extract(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	return report(c, result{Op: "extract", Source: path})
+}
+
+func shareCreate(c *cli.Context) error {
+	a, err := args(c, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	req := client.ShareRequest{
+		Path:         remotePath(a[0]),
+		Password:     c.String("password"),
+		MaxDownloads: c.Int("max-downloads"),
+	}
+
+	if c.Duration("expires-in") > 0 {
+		req.ExpiresIn = c.Duration("expires-in").String()
+	}
+
+	share, err := cl.CreateShare(c.Context, req)
+	if err != nil {
+		return err
+	}
+
+	return report(c, result{Op: "share", Source: share.Path, URL: share.URL})
+}
+
+func shareList(c *cli.Context) error {
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	shares, err := cl.Shares(c.Context)
+	if err != nil {
+		return err
+	}
+
+	for _, share := range shares {
+		if c.Bool("json") {
+			err = json.NewEncoder(os.Stdout).Encode(share)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("%s\t%s\texpires %s\t%d downloads\n", share.Path, share.URL, share.Expires.Local().Format(time.RFC3339), share.Downloads)
+	}
+
+	return nil
+}
+
+func shareRevoke(c *cli.Context) error {
+	a, err := args(c, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	err = cl.RevokeShare(c.Context, a[0])
+	if err != nil {
+		return err
+	}
+
+	return report(c, result{Op: "revoke", Source: a[0]})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_get(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.txt":
+			_, _ = io.WriteString(w, "new content")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "replaces existing file",
+			path: "/a.txt",
+			want: "new content",
+		},
+		{
+			name:    "failed download keeps existing file",
+			path:    "/broken.txt",
+			want:    "old content",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := filepath.Join(dir, "local.txt")
+
+			err := os.WriteFile(target, []byte("old content"), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = newApp().Run([]string{"dinghy", "--endpoint", srv.URL, "--quiet", "get", tt.path, target})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("get error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("directory contains %d files, want the target only", len(entries))
+			}
+		})
+	}
+}
+
+func Test_remotePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "a/b.txt", want: "/a/b.txt"},
+		{path: "/a/b.txt", want: "/a/b.txt"},
+		{path: "", want: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := remotePath(tt.path); got != tt.want {
+				t.Errorf("remotePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const barWidth = 30
+
+// progress draws a progress bar to stderr for the bytes written to it.
+type progress struct {
+	out     io.Writer
+	name    string
+	total   int64
+	current int64
+	drawn   time.Time
+}
+
+func newProgress(c *cli.Context, name string, total int64) *progress {
+	p := &progress{
+		name:  name,
+		total: total,
+	}
+
+	if !c.Bool("quiet") && !c.Bool("json") && isTerminal(os.Stderr) {
+		p.out = os.Stderr
+	}
+
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+
+	if time.Since(p.drawn) > 100*time.Millisecond {
+		p.draw()
+	}
+
+	return len(b), nil
+}
+
+func (p *progress) draw() {
+	if p.out == nil {
+		return
+	}
+
+	p.drawn = time.Now()
+
+	if p.total <= 0 {
+		fmt.Fprintf(p.out, "\r%s %s", humanBytes(p.current), p.name)
+		return
+	}
+
+	ratio := float64(p.current) / float64(p.total)
+	if ratio > 1 {
+		ratio = 1
+	}
+
+	filled := int(ratio * barWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(" ", barWidth-filled)
+
+	fmt.Fprintf(p.out, "\r[%s] %3.0f%% %s / %s %s", bar, ratio*100, humanBytes(p.current), humanBytes(p.total), p.name)
+}
+
+func (p *progress) done() {
+	if p.out == nil {
+		return
+	}
+
+	p.draw()
+	fmt.Fprintln(p.out)
+}
+
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -1,15 +1,22 @@
 package dinghy
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/pprof"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
 )
 
 // AdminServer answers to administration requests.
 type AdminServer struct {
 	router *http.ServeMux
+	Audit  *AuditLog
+	// AuditAuthenticators authenticate audit queries, which are refused without.
+	AuditAuthenticators []auth.Authenticator
+	// Degraded reports why the service is degraded, nil if it is fully functional.
+	Degraded func() error
 }
 
 // NewAdminServer creates a new administration server.
@@ -27,7 +34,10 @@ func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *AdminServer) routes() {
 	s.router = http.NewServeMux()
 	s.router.HandleFunc("/healthz", handleHealthz)
+	s.router.HandleFunc("/readyz", handleHealthz)
+	s.router.HandleFunc("/statusz", s.handleStatusz)
 	s.router.Handle("/metrics", promhttp.Handler())
+	s.router.HandleFunc("/audit", s.handleAudit)
 	s.router.HandleFunc("/debug/pprof/", pprof.Index)
 	s.router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 	s.router.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -38,3 +48,28 @@ func (s *AdminServer) routes() {
 func handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
+
+// handleAudit answers audit queries of authenticated users only,
+// the events contain user names and ips.
+func (s *AdminServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if len(s.AuditAuthenticators) == 0 {
+		http.Error(w, "audit queries need authentication to be configured", http.StatusForbidden)
+		return
+	}
+
+	auth.Authenticate(s.AuditAuthenticators, nil, nil, s.Audit).ServeHTTP(w, r)
+}
+
+// handleStatusz reports if the service is degraded.
+// A degraded service still serves requests and stays ready.
+func (s *AdminServer) handleStatusz(w http.ResponseWriter, r *http.Request) {
+	if s.Degraded != nil {
+		err := s.Degraded()
+		if err != nil {
+			fmt.Fprintf(w, "degraded: %v\n", err)
+			return
+		}
+	}
+
+	fmt.Fprintln(w, "ok")
+}
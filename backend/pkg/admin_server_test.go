@@ -0,0 +1,37 @@
+package dinghy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminServer_degraded(t *testing.T) {
+	tests := []struct {
+		name       string
+		degraded   error
+		wantStatus string
+	}{
+		{"fully functional", nil, "ok\n"},
+		{"notify unavailable", fmt.Errorf("notify unavailable"), "degraded: notify unavailable\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewAdminServer()
+			s.Degraded = func() error { return tt.degraded }
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("readyz code = %v, want %v", w.Code, http.StatusOK)
+			}
+
+			w = httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/statusz", nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.wantStatus {
+				t.Errorf("statusz = %v %q, want %v %q", w.Code, w.Body.String(), http.StatusOK, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package dinghy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+// auditDirectory is the append only prefix holding audit events in the bucket.
+const auditDirectory = "audit/"
+
+// audited operations
+const (
+	AuditUpload      = "upload"
+	AuditDelete      = "delete"
+	AuditExtract     = "extract"
+	AuditShareCreate = "share.create"
+	AuditShareRevoke = "share.revoke"
+)
+
+// results of audited operations
+const (
+	AuditOK         = "ok"
+	AuditFailed     = "failed"
+	AuditRejected   = "rejected"
+	AuditRedirected = "redirected"
+)
+
+const (
+	auditFlushInterval = 5 * time.Second
+	auditBatchSize     = 100
+)
+
+var errAuditNotQueryable = errors.New("audit log can not be queried")
+
+var auditDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "audit_events_dropped_total",
+		Help: "Count of audit events dropped because the audit log fell behind.",
+	},
+)
+
+// AuditEvent records a mutating operation.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	ClientIP  string    `json:"clientIp,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditStore persists audit events.
+type auditStore interface {
+	write(ctx context.Context, events []AuditEvent) error
+	// read calls fn for the events between since and until, it stops if fn returns false.
+	read(ctx context.Context, since, until time.Time, fn func(AuditEvent) bool) error
+}
+
+// AuditLog writes audit events in batches to its store.
+// A nil audit log records nothing.
+type AuditLog struct {
+	store  auditStore
+	events chan AuditEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewAuditLog creates an audit log, dest is "stdout", "bucket" to use the audit prefix of the storage or a file path.
+func NewAuditLog(dest string, storage *MinioAdapter) (*AuditLog, error) {
+	var store auditStore
+
+	switch dest {
+	case "stdout", "-":
+		store = &streamAudit{w: os.Stdout}
+	case "bucket":
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("hostname: %v", err)
+		}
+		store = &bucketAudit{storage: storage, host: host}
+	default:
+		f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log %s: %v", dest, err)
+		}
+		store = &fileAudit{path: dest, f: f}
+	}
+
+	return newAuditLog(store), nil
+}
+
+func newAuditLog(store auditStore) *AuditLog {
+	a := &AuditLog{
+		store:  store,
+		events: make(chan AuditEvent, auditBatchSize),
+		done:   make(chan struct{}),
+	}
+
+	go a.run()
+
+	return a
+}
+
+func (a *AuditLog) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := []AuditEvent{}
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := a.store.write(context.Background(), batch)
+		if err != nil {
+			log.Printf("write %d audit events: %v", len(batch), err)
+			for _, e := range batch {
+				b, _ := json.Marshal(e)
+				log.Printf("audit: %s", b)
+			}
+		}
+
+		batch = []AuditEvent{}
+	}
+
+	for {
+		select {
+		case e, ok := <-a.events:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) >= auditBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Record queues an event to be written.
+// Requests do not wait for a store falling behind, the event is logged and dropped instead.
+func (a *AuditLog) Record(e AuditEvent) {
+	if a == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	select {
+	case a.events <- e:
+	default:
+		auditDropped.Inc()
+		b, _ := json.Marshal(e)
+		log.Printf("audit queue full, dropped: %s", b)
+	}
+}
+
+// Close writes the queued events.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.once.Do(func() { close(a.events) })
+	<-a.done
+
+	if c, ok := a.store.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// auditQuery selects audit events.
+type auditQuery struct {
+	since     time.Time
+	until     time.Time
+	user      string
+	operation string
+	prefix    string
+	limit     int
+}
+
+func parseAuditQuery(r *http.Request) (auditQuery, error) {
+	v := r.URL.Query()
+
+	q := auditQuery{
+		user:      v.Get("user"),
+		operation: v.Get("operation"),
+		prefix:    v.Get("path"),
+		limit:     1000,
+		until:     time.Now().UTC(),
+	}
+
+	var err error
+
+	if v.Get("since") != "" {
+		q.since, err = time.Parse(time.RFC3339, v.Get("since"))
+		if err != nil {
+			return auditQuery{}, fmt.Errorf("since: %v", err)
+		}
+	}
+
+	if v.Get("until") != "" {
+		q.until, err = time.Parse(time.RFC3339, v.Get("until"))
+		if err != nil {
+			return auditQuery{}, fmt.Errorf("until: %v", err)
+		}
+	}
+
+	if v.Get("limit") != "" {
+		q.limit, err = strconv.Atoi(v.Get("limit"))
+		if err != nil || q.limit < 1 {
+			return auditQuery{}, fmt.Errorf("limit needs to be a positive number")
+		}
+	}
+
+	return q, nil
+}
+
+func (q auditQuery) matches(e AuditEvent) bool {
+	return !e.Time.Before(q.since) && !e.Time.After(q.until) &&
+		(q.user == "" || e.User == q.user) &&
+		(q.operation == "" || e.Operation == q.operation) &&
+		strings.HasPrefix(e.Path, q.prefix)
+}
+
+// ServeHTTP answers queries like /audit?since=2024-01-01T00:00:00Z&user=alice&path=/projects/
+// with the matching events as json lines.
+func (a *AuditLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a == nil {
+		http.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+
+	q, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events := []AuditEvent{}
+
+	err = a.store.read(r.Context(), q.since, q.until, func(e AuditEvent) bool {
+		if q.matches(e) {
+			events = append(events, e)
+		}
+		return len(events) < q.limit
+	})
+	if err == errAuditNotQueryable {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("query audit log: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	e := json.NewEncoder(w)
+	for _, event := range events {
+		err = e.Encode(event)
+		if err != nil {
+			log.Printf("query audit log: respond: %v", err)
+			return
+		}
+	}
+}
+
+// streamAudit writes events as json lines to a stream which can not be read back.
+type streamAudit struct {
+	w io.Writer
+}
+
+func (s *streamAudit) write(ctx context.Context, events []AuditEvent) error {
+	_, err := s.w.Write(encodeAuditEvents(events))
+	return err
+}
+
+func (s *streamAudit) read(ctx context.Context, since, until time.Time, fn func(AuditEvent) bool) error {
+	return errAuditNotQueryable
+}
+
+// fileAudit appends events as json lines to a file.
+type fileAudit struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func (s *fileAudit) write(ctx context.Context, events []AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.f.Write(encodeAuditEvents(events))
+	if err != nil {
+		return err
+	}
+
+	return s.f.Sync()
+}
+
+func (s *fileAudit) read(ctx context.Context, since, until time.Time, fn func(AuditEvent) bool) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = decodeAuditEvents(f, fn)
+	return err
+}
+
+func (s *fileAudit) Close() error {
+	return s.f.Close()
+}
+
+// bucketAudit stores every batch of events as a new object below the audit prefix.
+// Objects are named by day and time so that listing them returns the events in order.
+type bucketAudit struct {
+	storage *MinioAdapter
+	host    string
+	mu      sync.Mutex
+	seq     int
+}
+
+func (s *bucketAudit) write(ctx context.Context, events []AuditEvent) error {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	t := events[0].Time.UTC()
+	key := fmt.Sprintf("%s%s/%s-%s-%d.jsonl", auditDirectory, t.Format("2006-01-02"), t.Format("150405.000000000"), s.host, seq)
+
+	return s.storage.putObject(ctx, key, encodeAuditEvents(events), "application/x-ndjson")
+}
+
+func (s *bucketAudit) read(ctx context.Context, since, until time.Time, fn func(AuditEvent) bool) error {
+	keys, err := s.storage.listKeys(ctx, auditDirectory)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		day, err := time.Parse("2006-01-02", strings.SplitN(strings.TrimPrefix(key, auditDirectory), "/", 2)[0])
+		if err != nil || day.AddDate(0, 0, 1).Before(since) || day.After(until) {
+			continue
+		}
+
+		b, err := s.storage.getObject(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		more, err := decodeAuditEvents(bytes.NewReader(b), fn)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func encodeAuditEvents(events []AuditEvent) []byte {
+	buf := &bytes.Buffer{}
+
+	e := json.NewEncoder(buf)
+	for _, event := range events {
+		// events only contain marshallable fields
+		_ = e.Encode(event)
+	}
+
+	return buf.Bytes()
+}
+
+// decodeAuditEvents calls fn for each json line and reports if fn wants more.
+func decodeAuditEvents(r io.Reader, fn func(AuditEvent) bool) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		e := AuditEvent{}
+
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return false, err
+		}
+
+		if !fn(e) {
+			return false, nil
+		}
+	}
+
+	return true, scanner.Err()
+}
+
+// audit records an operation of the request.
+func (s *ServiceServer) audit(r *http.Request, operation, path string, size int64, result string, err error) {
+	if s.Audit == nil {
+		return
+	}
+
+	e := AuditEvent{
+		RequestID: r.Header.Get("X-Request-Id"),
+		ClientIP:  auth.ClientIP(r, s.TrustProxy),
+		User:      userFromContext(r.Context()).Name,
+		Operation: operation,
+		Path:      path,
+		Bytes:     size,
+		Result:    result,
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	s.Audit.Record(e)
+}
+
+// auditResult classifies the outcome of an operation.
+func auditResult(err error) string {
+	uerr := uploadError{}
+	switch {
+	case err == nil:
+		return AuditOK
+	case errors.As(err, &uerr):
+		return AuditRejected
+	default:
+		return AuditFailed
+	}
+}
@@ -0,0 +1,185 @@
+package dinghy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+func TestAuditLog_ServeHTTP(t *testing.T) {
+	a, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := []AuditEvent{
+		{Time: start, User: "alice", Operation: AuditUpload, Path: "/projects/plan.txt", Bytes: 42, Result: AuditOK},
+		{Time: start.Add(time.Hour), User: "bob", Operation: AuditDelete, Path: "/projects/plan.txt", Result: AuditOK},
+		{Time: start.Add(2 * time.Hour), User: "alice", Operation: AuditExtract, Path: "/home/alice/a.zip", Result: AuditFailed, Error: "target exists"},
+	}
+	for _, e := range events {
+		a.Record(e)
+	}
+
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{0, 1, 2}},
+		{"user=alice", []int{0, 2}},
+		{"operation=delete", []int{1}},
+		{"path=/projects/", []int{0, 1}},
+		{fmt.Sprintf("since=%s", start.Add(30*time.Minute).Format(time.RFC3339)), []int{1, 2}},
+		{fmt.Sprintf("until=%s", start.Add(30*time.Minute).Format(time.RFC3339)), []int{0}},
+		{"limit=2", []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?"+tt.query, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("ServeHTTP() code = %v", w.Code)
+			}
+
+			got := []AuditEvent{}
+			scanner := bufio.NewScanner(w.Body)
+			for scanner.Scan() {
+				e := AuditEvent{}
+				err := json.Unmarshal(scanner.Bytes(), &e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("ServeHTTP() = %v, want events %v", got, tt.want)
+			}
+			for i, j := range tt.want {
+				if got[i] != events[j] {
+					t.Errorf("ServeHTTP() event %d = %v, want %v", i, got[i], events[j])
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLog_ServeHTTP_invalidQuery(t *testing.T) {
+	a := newAuditLog(&streamAudit{})
+	defer a.Close()
+
+	for _, query := range []string{"since=yesterday", "limit=0"} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/audit?"+query, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("ServeHTTP(%s) code = %v, want %v", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// blockedAudit is a store which does not write until it is released.
+type blockedAudit struct {
+	streamAudit
+	release chan struct{}
+}
+
+func (b *blockedAudit) write(ctx context.Context, events []AuditEvent) error {
+	<-b.release
+	return nil
+}
+
+func TestAuditLog_Record_full(t *testing.T) {
+	store := &blockedAudit{release: make(chan struct{})}
+	a := newAuditLog(store)
+
+	dropped := testutil.ToFloat64(auditDropped)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3*auditBatchSize; i++ {
+			a.Record(AuditEvent{Operation: AuditUpload, Path: fmt.Sprintf("/%d.txt", i)})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Record() blocked on a store falling behind")
+	}
+
+	if testutil.ToFloat64(auditDropped) <= dropped {
+		t.Error("no audit event counted as dropped")
+	}
+
+	close(store.release)
+	a.Close()
+}
+
+func TestAdminServer_audit(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	err := os.WriteFile(tokenFile, []byte("s3cr3t auditor\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := auth.LoadBearerTokens(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		authenticators []auth.Authenticator
+		token          string
+		wantCode       int
+	}{
+		{"authentication not configured", nil, "s3cr3t", http.StatusForbidden},
+		{"token missing", []auth.Authenticator{tokens}, "", http.StatusUnauthorized},
+		{"wrong token", []auth.Authenticator{tokens}, "guess", http.StatusUnauthorized},
+		{"valid token", []auth.Authenticator{tokens}, "s3cr3t", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAuditLog(filepath.Join(t.TempDir(), "audit.log"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer a.Close()
+
+			s := NewAdminServer()
+			s.Audit = a
+			s.AuditAuthenticators = tt.authenticators
+
+			r := httptest.NewRequest(http.MethodGet, "/audit", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/middleware"
+)
+
+// User is the identity of an authenticated client.
+type User struct {
+	Name   string   `json:"name"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type userKey struct{}
+
+// WithUser stores the user in the context.
+func WithUser(ctx context.Context, u User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// UserFromContext returns the authenticated user of a request.
+func UserFromContext(ctx context.Context) (User, bool) {
+	u, ok := ctx.Value(userKey{}).(User)
+	return u, ok
+}
+
+// Authenticator identifies the user of a request.
+// It returns found=false if the request carries no credentials it is responsible for.
+type Authenticator interface {
+	Authenticate(r *http.Request) (u User, found bool, err error)
+	// Challenge is the value for the WWW-Authenticate header, empty if none.
+	Challenge() string
+}
+
+// Authenticate rejects requests without valid credentials.
+// Requests are passed to the first authenticator that finds credentials.
+// Unauthenticated browsers are redirected to the login of the OIDC provider if configured.
+// Requests matching public are passed on without authentication.
+func Authenticate(authenticators []Authenticator, oidc *OIDC, public func(*http.Request) bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || (public != nil && public(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if oidc != nil && oidc.handles(r) {
+			oidc.ServeHTTP(w, r)
+			return
+		}
+
+		for _, a := range authenticators {
+			u, found, err := a.Authenticate(r)
+			if !found {
+				continue
+			}
+
+			if err != nil {
+				log.Printf("authenticate %s %s: %v", r.Method, r.URL.Path, err)
+				unauthorized(w, authenticators)
+				return
+			}
+
+			span := opentracing.SpanFromContext(r.Context())
+			if span != nil {
+				span.SetTag("user", u.Name)
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), u)))
+			return
+		}
+
+		if oidc != nil && isBrowserNavigation(r) {
+			oidc.redirectToLogin(w, r)
+			return
+		}
+
+		unauthorized(w, authenticators)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, authenticators []Authenticator) {
+	for _, a := range authenticators {
+		challenge := a.Challenge()
+		if challenge != "" {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func isBrowserNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet || middleware.IsWebsocket(r) {
+		return false
+	}
+
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
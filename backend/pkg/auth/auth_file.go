@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// BearerTokens authenticates static bearer tokens.
+type BearerTokens struct {
+	tokens map[string]User
+}
+
+// LoadBearerTokens reads tokens from a file.
+// Each line contains a token, the user name and optionally a comma separated list of groups.
+// Empty lines and lines starting with # are ignored.
+func LoadBearerTokens(path string) (*BearerTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open token file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	return parseBearerTokens(f)
+}
+
+func parseBearerTokens(r io.Reader) (*BearerTokens, error) {
+	b := &BearerTokens{tokens: map[string]User{}}
+
+	err := scanLines(r, func(no int, line string) error {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("line %d: expected token, user and optional groups", no)
+		}
+
+		u := User{Name: fields[1]}
+		if len(fields) == 3 {
+			u.Groups = strings.Split(fields[2], ",")
+		}
+
+		b.tokens[fields[0]] = u
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *BearerTokens) Authenticate(r *http.Request) (User, bool, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return User{}, false, nil
+	}
+
+	for t, u := range b.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return u, true, nil
+		}
+	}
+
+	return User{}, true, fmt.Errorf("unknown bearer token")
+}
+
+func (b *BearerTokens) Challenge() string {
+	return `Bearer realm="dinghy"`
+}
+
+// Htpasswd authenticates http basic auth credentials against a htpasswd file.
+// Supported are bcrypt and {SHA} hashes.
+type Htpasswd struct {
+	hashes map[string]string
+}
+
+// LoadHtpasswd reads the users from a htpasswd file.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open htpasswd file %s: %v", path, err)
+	}
+	defer f.Close()
+
+	return parseHtpasswd(f)
+}
+
+func parseHtpasswd(r io.Reader) (*Htpasswd, error) {
+	h := &Htpasswd{hashes: map[string]string{}}
+
+	err := scanLines(r, func(no int, line string) error {
+		user, hash, found := strings.Cut(line, ":")
+		if !found {
+			return fmt.Errorf("line %d: expected user:hash", no)
+		}
+
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return fmt.Errorf("line %d: hash of user %s not supported, use bcrypt or sha1", no, user)
+		}
+
+		h.hashes[user] = hash
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *Htpasswd) Authenticate(r *http.Request) (User, bool, error) {
+	user, password, found := r.BasicAuth()
+	if !found {
+		return User{}, false, nil
+	}
+
+	hash, known := h.hashes[user]
+	if !known {
+		return User{}, true, fmt.Errorf("unknown user %s", user)
+	}
+
+	if !verifyHtpasswd(hash, password) {
+		return User{}, true, fmt.Errorf("wrong password for user %s", user)
+	}
+
+	return User{Name: user}, true, nil
+}
+
+func (h *Htpasswd) Challenge() string {
+	return `Basic realm="dinghy", charset="UTF-8"`
+}
+
+func verifyHtpasswd(hash, password string) bool {
+	if sha, found := strings.CutPrefix(hash, "{SHA}"); found {
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(sha), []byte(expected)) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func scanLines(r io.Reader, fn func(no int, line string) error) error {
+	s := bufio.NewScanner(r)
+
+	for no := 1; s.Scan(); no++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		err := fn(no, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
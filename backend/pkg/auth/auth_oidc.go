@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionCookie = "dinghy_session"
+	stateCookie   = "dinghy_oidc_state"
+	loginPath     = "/auth/login"
+	logoutPath    = "/auth/logout"
+)
+
+// Kinds of signed values, a value signed as one kind does not verify as another.
+const (
+	kindSession = "session"
+	kindState   = "state"
+)
+
+// OIDC authenticates users with the authorization code flow of an OpenID Connect provider.
+// Authenticated users are remembered in a signed session cookie.
+type OIDC struct {
+	verifier     *oidc.IDTokenVerifier
+	config       oauth2.Config
+	callbackPath string
+	userClaim    string
+	groupsClaim  string
+	sessionTTL   time.Duration
+	key          []byte
+	secure       bool
+}
+
+// NewOIDC discovers the provider at issuer.
+// The path of redirectURL is served as callback.
+// Users are named by userClaim, "sub" if empty; an "email" claim is only accepted if it is verified.
+func NewOIDC(ctx context.Context, issuer, clientID, clientSecret, redirectURL string, scopes []string,
+	userClaim, groupsClaim string, sessionKey []byte, sessionTTL time.Duration) (*OIDC, error) {
+	if len(sessionKey) < 32 {
+		return nil, fmt.Errorf("session key needs at least 32 bytes")
+	}
+
+	callback, err := url.Parse(redirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redirect url %s: %v", redirectURL, err)
+	}
+
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discover provider %s: %v", issuer, err)
+	}
+
+	return &OIDC{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		callbackPath: callback.Path,
+		userClaim:    userClaim,
+		groupsClaim:  groupsClaim,
+		sessionTTL:   sessionTTL,
+		key:          sessionKey,
+		secure:       callback.Scheme == "https",
+	}, nil
+}
+
+type session struct {
+	User    User  `json:"user"`
+	Expires int64 `json:"exp"`
+}
+
+type loginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+func (o *OIDC) Authenticate(r *http.Request) (User, bool, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, false, nil
+	}
+
+	s := session{}
+
+	err = o.verify(kindSession, c.Value, &s)
+	if err != nil {
+		return User{}, true, fmt.Errorf("session cookie: %v", err)
+	}
+
+	if s.User.Name == "" {
+		return User{}, true, fmt.Errorf("session cookie: user missing")
+	}
+
+	if time.Now().Unix() > s.Expires {
+		// expired sessions are treated like missing ones to trigger a new login
+		return User{}, false, nil
+	}
+
+	return s.User, true, nil
+}
+
+func (o *OIDC) Challenge() string {
+	return ""
+}
+
+func (o *OIDC) handles(r *http.Request) bool {
+	switch r.URL.Path {
+	case loginPath, logoutPath, o.callbackPath:
+		return true
+	}
+
+	return false
+}
+
+func (o *OIDC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case loginPath:
+		o.login(w, r, r.URL.Query().Get("redirect"))
+	case logoutPath:
+		o.setCookie(w, sessionCookie, "", -1)
+		http.Redirect(w, r, "/", http.StatusFound)
+	case o.callbackPath:
+		o.callback(w, r)
+	}
+}
+
+func (o *OIDC) redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	o.login(w, r, r.URL.RequestURI())
+}
+
+func (o *OIDC) login(w http.ResponseWriter, r *http.Request, redirect string) {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+
+	s := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Redirect: redirect,
+		Expires:  time.Now().Add(10 * time.Minute).Unix(),
+	}
+
+	value, err := o.sign(kindState, s)
+	if err != nil {
+		log.Printf("sign login state: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	o.setCookie(w, stateCookie, value, 600)
+
+	http.Redirect(w, r, o.config.AuthCodeURL(s.State, oidc.Nonce(s.Nonce)), http.StatusFound)
+}
+
+func (o *OIDC) callback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	c, err := r.Cookie(stateCookie)
+	if err != nil {
+		http.Error(w, "login state missing", http.StatusBadRequest)
+		return
+	}
+
+	s := loginState{}
+
+	err = o.verify(kindState, c.Value, &s)
+	if err != nil || time.Now().Unix() > s.Expires || r.URL.Query().Get("state") != s.State {
+		http.Error(w, "login state invalid", http.StatusBadRequest)
+		return
+	}
+
+	o.setCookie(w, stateCookie, "", -1)
+
+	token, err := o.config.Exchange(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		log.Printf("oidc: exchange code: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("oidc: id token missing")
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != s.Nonce {
+		log.Printf("oidc: verify id token: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	u, err := o.user(idToken)
+	if err != nil {
+		log.Printf("oidc: read claims: %v", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	value, err := o.sign(kindSession, session{User: u, Expires: time.Now().Add(o.sessionTTL).Unix()})
+	if err != nil {
+		log.Printf("sign session: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	o.setCookie(w, sessionCookie, value, int(o.sessionTTL.Seconds()))
+
+	http.Redirect(w, r, s.Redirect, http.StatusFound)
+}
+
+func (o *OIDC) user(idToken *oidc.IDToken) (User, error) {
+	claims := map[string]interface{}{}
+
+	err := idToken.Claims(&claims)
+	if err != nil {
+		return User{}, err
+	}
+
+	return o.userFromClaims(claims)
+}
+
+// userFromClaims names the user by the configured claim, which has to be present.
+func (o *OIDC) userFromClaims(claims map[string]interface{}) (User, error) {
+	name, _ := claims[o.userClaim].(string)
+	if name == "" {
+		return User{}, fmt.Errorf("claim %s missing", o.userClaim)
+	}
+
+	if o.userClaim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return User{}, fmt.Errorf("email %s not verified", name)
+		}
+	}
+
+	u := User{Name: name}
+
+	groups, _ := claims[o.groupsClaim].([]interface{})
+	for _, g := range groups {
+		if group, ok := g.(string); ok {
+			u.Groups = append(u.Groups, group)
+		}
+	}
+
+	return u, nil
+}
+
+func (o *OIDC) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   o.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sign encodes v with a signature covering the kind of the value.
+func (o *OIDC) sign(kind string, v interface{}) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(o.mac(kind, payload)), nil
+}
+
+func (o *OIDC) verify(kind, value string, v interface{}) error {
+	enc := base64.RawURLEncoding
+
+	p, s, found := strings.Cut(value, ".")
+	if !found {
+		return fmt.Errorf("malformed")
+	}
+
+	payload, err := enc.DecodeString(p)
+	if err != nil {
+		return fmt.Errorf("decode payload: %v", err)
+	}
+
+	signature, err := enc.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("decode signature: %v", err)
+	}
+
+	if !hmac.Equal(signature, o.mac(kind, payload)) {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	return json.Unmarshal(payload, v)
+}
+
+func (o *OIDC) mac(kind string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOIDC_Authenticate(t *testing.T) {
+	o := &OIDC{key: []byte("0123456789abcdef0123456789abcdef"), sessionTTL: time.Hour}
+
+	sign := func(kind string, v interface{}) string {
+		value, err := o.sign(kind, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	valid := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name      string
+		cookie    string
+		wantUser  string
+		wantFound bool
+		wantErr   bool
+	}{
+		{
+			name: "no cookie",
+		},
+		{
+			name:      "session",
+			cookie:    sign(kindSession, session{User: User{Name: "alice"}, Expires: valid}),
+			wantUser:  "alice",
+			wantFound: true,
+		},
+		{
+			name:      "login state replayed as session",
+			cookie:    sign(kindState, loginState{State: "s", Nonce: "n", Redirect: "/", Expires: valid}),
+			wantFound: true,
+			wantErr:   true,
+		},
+		{
+			name:      "session without user",
+			cookie:    sign(kindSession, session{Expires: valid}),
+			wantFound: true,
+			wantErr:   true,
+		},
+		{
+			name:      "tampered session",
+			cookie:    sign(kindSession, session{User: User{Name: "alice"}, Expires: valid}) + "x",
+			wantFound: true,
+			wantErr:   true,
+		},
+		{
+			name:   "expired session",
+			cookie: sign(kindSession, session{User: User{Name: "alice"}, Expires: time.Now().Add(-time.Hour).Unix()}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+			}
+
+			u, found, err := o.Authenticate(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if found != tt.wantFound {
+				t.Errorf("Authenticate() found = %v, want %v", found, tt.wantFound)
+			}
+			if u.Name != tt.wantUser {
+				t.Errorf("Authenticate() user = %q, want %q", u.Name, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestOIDC_userFromClaims(t *testing.T) {
+	tests := []struct {
+		name      string
+		userClaim string
+		claims    map[string]interface{}
+		want      User
+		wantErr   bool
+	}{
+		{
+			name:      "subject",
+			userClaim: "sub",
+			claims:    map[string]interface{}{"sub": "1234", "preferred_username": "admin", "groups": []interface{}{"dev"}},
+			want:      User{Name: "1234", Groups: []string{"dev"}},
+		},
+		{
+			name:      "verified email",
+			userClaim: "email",
+			claims:    map[string]interface{}{"sub": "1234", "email": "alice@example.com", "email_verified": true},
+			want:      User{Name: "alice@example.com"},
+		},
+		{
+			name:      "unverified email",
+			userClaim: "email",
+			claims:    map[string]interface{}{"sub": "1234", "email": "admin@example.com", "email_verified": false},
+			wantErr:   true,
+		},
+		{
+			name:      "claim missing",
+			userClaim: "preferred_username",
+			claims:    map[string]interface{}{"sub": "1234"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &OIDC{userClaim: tt.userClaim, groupsClaim: "groups"}
+
+			got, err := o.userFromClaims(tt.claims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("userFromClaims() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("userFromClaims() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
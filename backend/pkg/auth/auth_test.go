@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	htpasswd, err := parseHtpasswd(strings.NewReader(
+		"alice:" + string(hash) + "\n" +
+			"# sha1 of password\n" +
+			"bob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := parseBearerTokens(strings.NewReader("s3cr3t ci deploy,build\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(r *http.Request)
+		wantCode int
+		wantUser string
+	}{
+		{
+			name:     "no credentials",
+			setup:    func(r *http.Request) {},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "basic auth bcrypt",
+			setup:    func(r *http.Request) { r.SetBasicAuth("alice", "secret") },
+			wantCode: http.StatusOK,
+			wantUser: "alice",
+		},
+		{
+			name:     "basic auth sha1",
+			setup:    func(r *http.Request) { r.SetBasicAuth("bob", "password") },
+			wantCode: http.StatusOK,
+			wantUser: "bob",
+		},
+		{
+			name:     "basic auth wrong password",
+			setup:    func(r *http.Request) { r.SetBasicAuth("alice", "wrong") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "basic auth unknown user",
+			setup:    func(r *http.Request) { r.SetBasicAuth("mallory", "secret") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "bearer token",
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") },
+			wantCode: http.StatusOK,
+			wantUser: "ci",
+		},
+		{
+			name:     "unknown bearer token",
+			setup:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") },
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "websocket upgrade without credentials",
+			setup: func(r *http.Request) {
+				r.Header.Set("Connection", "Upgrade")
+				r.Header.Set("Upgrade", "websocket")
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := ""
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				u, _ := UserFromContext(r.Context())
+				user = u.Name
+			})
+
+			h := Authenticate([]Authenticator{tokens, htpasswd}, nil, nil, next)
+
+			r := httptest.NewRequest(http.MethodGet, "/file.txt?redirect", nil)
+			tt.setup(r)
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Authenticate() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if user != tt.wantUser {
+				t.Errorf("Authenticate() user = %v, want %v", user, tt.wantUser)
+			}
+			if w.Code == http.StatusUnauthorized && len(w.Header().Values("WWW-Authenticate")) != 2 {
+				t.Errorf("Authenticate() challenges = %v, want 2", w.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/middleware"
+	"golang.org/x/time/rate"
+)
+
+// Class groups requests sharing a budget.
+type Class string
+
+const (
+	ClassList      Class = "list"
+	ClassDownload  Class = "download"
+	ClassUpload    Class = "upload"
+	ClassThumbnail Class = "thumbnail"
+	// ClassWebsocket limits long running streams, websockets as well as server-sent events.
+	ClassWebsocket Class = "websocket"
+	// ClassRequest limits all requests of an ip before they are authenticated.
+	ClassRequest Class = "request"
+)
+
+var rateLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_requests_rate_limited_total",
+		Help: "Count of requests rejected by rate and concurrency limits.",
+	},
+	[]string{"class", "reason"},
+)
+
+// RegisterMetrics registers the metrics of the rate limiter.
+func RegisterMetrics(r prometheus.Registerer) error {
+	return r.Register(rateLimitedTotal)
+}
+
+func countRateLimited(class Class, reason string) {
+	rateLimitedTotal.WithLabelValues(string(class), reason).Inc()
+}
+
+// idleTimeout is the time after which the budgets of idle clients are forgotten.
+const idleTimeout = 10 * time.Minute
+
+// Limit is the budget of a single client for a class of requests.
+// Rate is the number of requests per second refilling a bucket of Burst requests,
+// Concurrency limits the requests in flight, zero means unlimited.
+type Limit struct {
+	Rate        float64 `json:"rate"`
+	Burst       int     `json:"burst"`
+	Concurrency int     `json:"concurrency,omitempty"`
+}
+
+// RateLimiter keeps token buckets per class and client.
+// Clients are identified by the authenticated user or else by their ip.
+// A nil rate limiter allows everything.
+type RateLimiter struct {
+	limits map[Class]Limit
+	// trustProxy takes the client ip from the X-Forwarded-For header set by a reverse proxy.
+	trustProxy bool
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	class  Class
+	client string
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	active   int
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a rate limiter, classes without limit are unlimited.
+func NewRateLimiter(limits map[Class]Limit, trustProxy bool) *RateLimiter {
+	return &RateLimiter{
+		limits:     limits,
+		trustProxy: trustProxy,
+		buckets:    map[bucketKey]*bucket{},
+		lastSweep:  time.Now(),
+	}
+}
+
+// LoadRateLimits reads the limits per class from a json file.
+func LoadRateLimits(path string) (map[Class]Limit, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rate limits %s: %v", path, err)
+	}
+
+	limits := map[Class]Limit{}
+
+	err = json.Unmarshal(b, &limits)
+	if err != nil {
+		return nil, fmt.Errorf("parse rate limits %s: %v", path, err)
+	}
+
+	for class, l := range limits {
+		switch class {
+		case ClassList, ClassDownload, ClassUpload, ClassThumbnail, ClassWebsocket, ClassRequest:
+		default:
+			return nil, fmt.Errorf("rate limits %s: unknown class %s", path, class)
+		}
+
+		if l.Rate <= 0 || l.Burst < 1 || l.Concurrency < 0 {
+			return nil, fmt.Errorf("rate limits %s: class %s needs a positive rate and burst", path, class)
+		}
+	}
+
+	return limits, nil
+}
+
+// Acquire takes a token of the client for the class and occupies one of its concurrent slots.
+// If the budget is exhausted it returns how long to wait before retrying.
+// Release needs to be called once the request finished.
+func (l *RateLimiter) Acquire(class Class, client string) (release func(), retryAfter time.Duration, ok bool) {
+	if l == nil {
+		return func() {}, 0, true
+	}
+
+	limit, found := l.limits[class]
+	if !found {
+		return func() {}, 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(class, client, limit)
+
+	if limit.Concurrency > 0 && b.active >= limit.Concurrency {
+		countRateLimited(class, "concurrency")
+		return nil, time.Second, false
+	}
+
+	retryAfter, ok = take(b, class)
+	if !ok {
+		return nil, retryAfter, false
+	}
+
+	b.active++
+
+	once := sync.Once{}
+	release = func() {
+		once.Do(func() {
+			l.mu.Lock()
+			b.active--
+			l.mu.Unlock()
+		})
+	}
+
+	return release, 0, true
+}
+
+// Allow takes a token of the client for the class without occupying a slot,
+// it limits events inside of long running requests like websocket commands.
+func (l *RateLimiter) Allow(class Class, client string) (retryAfter time.Duration, ok bool) {
+	if l == nil {
+		return 0, true
+	}
+
+	limit, found := l.limits[class]
+	if !found {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return take(l.bucket(class, client, limit), class)
+}
+
+func (l *RateLimiter) bucket(class Class, client string, limit Limit) *bucket {
+	now := time.Now()
+	l.sweep(now)
+
+	key := bucketKey{class: class, client: client}
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	return b
+}
+
+func take(b *bucket, class Class) (time.Duration, bool) {
+	now := time.Now()
+
+	reservation := b.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > 0 {
+		reservation.CancelAt(now)
+		countRateLimited(class, "rate")
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// sweep forgets idle clients whose buckets are full again.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleTimeout {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.active == 0 && now.Sub(b.lastSeen) > idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Client identifies the client of a request by user name or ip.
+func (l *RateLimiter) Client(r *http.Request) string {
+	u, ok := UserFromContext(r.Context())
+	if ok && u.Name != "" {
+		return "user:" + u.Name
+	}
+
+	trustProxy := false
+	if l != nil {
+		trustProxy = l.trustProxy
+	}
+
+	return "ip:" + ClientIP(r, trustProxy)
+}
+
+// RateLimit rejects requests of clients which exhausted the budget of the request class.
+// It needs to run after Authenticate to tell users apart.
+func RateLimit(l *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit(w, r, l, Classify(r), l.Client(r), next)
+	})
+}
+
+// RateLimitIP rejects requests of ips which exhausted the budget of the request class.
+// It runs before Authenticate, so that failed logins and unauthenticated requests are limited as well.
+func RateLimitIP(l *RateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit(w, r, l, ClassRequest, "ip:"+ClientIP(r, l.trustProxy), next)
+	})
+}
+
+func limit(w http.ResponseWriter, r *http.Request, l *RateLimiter, class Class, client string, next http.Handler) {
+	release, retryAfter, ok := l.Acquire(class, client)
+	if !ok {
+		log.Printf("%s %s: rate limited %s of %s", r.Method, r.URL.Path, class, client)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, fmt.Sprintf("too many %s requests", class), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	next.ServeHTTP(w, r)
+}
+
+// Classify assigns the request to the class of its budget.
+func Classify(r *http.Request) Class {
+	if middleware.IsWebsocket(r) || middleware.IsEventStream(r) {
+		return ClassWebsocket
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if _, ok := r.URL.Query()["thumbnail"]; ok {
+			return ClassThumbnail
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			return ClassList
+		}
+		return ClassDownload
+	default:
+		return ClassUpload
+	}
+}
+
+// ClientIP returns the ip of the client.
+// Behind a reverse proxy the last address of X-Forwarded-For, added by the proxy, is used.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			ip := strings.TrimSpace(addrs[len(addrs)-1])
+			if ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
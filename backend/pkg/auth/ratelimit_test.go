@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	limits := map[Class]Limit{
+		ClassList:     {Rate: 0.001, Burst: 2},
+		ClassDownload: {Rate: 1000, Burst: 1000, Concurrency: 1},
+	}
+
+	tests := []struct {
+		name     string
+		requests []string
+		user     string
+		wantCode []int
+	}{
+		{
+			name:     "burst of listings",
+			requests: []string{"/", "/a/", "/b/"},
+			wantCode: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "classes have separate budgets",
+			requests: []string{"/", "/", "/file.txt", "/upload.txt"},
+			wantCode: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:     "users have separate budgets",
+			requests: []string{"/", "/", "/"},
+			user:     "alice",
+			wantCode: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(limits, false)
+			h := RateLimit(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			// exhaust the budget of another client
+			for i := 0; i < 3; i++ {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "192.0.2.2:1234"
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			for i, path := range tt.requests {
+				method := http.MethodGet
+				if path == "/upload.txt" {
+					method = http.MethodPut
+				}
+
+				r := httptest.NewRequest(method, path, nil)
+				if tt.user != "" {
+					r = r.WithContext(WithUser(r.Context(), User{Name: tt.user}))
+					r.RemoteAddr = "192.0.2.2:1234"
+				}
+				w := httptest.NewRecorder()
+
+				h.ServeHTTP(w, r)
+
+				if w.Code != tt.wantCode[i] {
+					t.Errorf("request %d %s: code = %v, want %v", i, path, w.Code, tt.wantCode[i])
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d %s: Retry-After missing", i, path)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitIP(t *testing.T) {
+	tokens, err := parseBearerTokens(strings.NewReader("s3cr3t ci\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewRateLimiter(map[Class]Limit{ClassRequest: {Rate: 0.001, Burst: 2}}, false)
+	h := RateLimitIP(l, Authenticate([]Authenticator{tokens}, nil, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		remoteAddr string
+		token      string
+		wantCode   int
+	}{
+		{"192.0.2.1:1234", "guess1", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "guess2", http.StatusUnauthorized},
+		{"192.0.2.1:1234", "s3cr3t", http.StatusTooManyRequests},
+		{"192.0.2.2:1234", "s3cr3t", http.StatusOK},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.wantCode {
+			t.Errorf("request %d from %s: code = %v, want %v", i, tt.remoteAddr, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestRateLimiter_concurrency(t *testing.T) {
+	l := NewRateLimiter(map[Class]Limit{ClassDownload: {Rate: 1000, Burst: 1000, Concurrency: 1}}, false)
+
+	release, _, ok := l.Acquire(ClassDownload, "ip:192.0.2.1")
+	if !ok {
+		t.Fatal("first request rejected")
+	}
+
+	_, retryAfter, ok := l.Acquire(ClassDownload, "ip:192.0.2.1")
+	if ok || retryAfter <= 0 {
+		t.Errorf("Acquire() = %v, %v while slot is taken", ok, retryAfter)
+	}
+
+	release()
+	release()
+
+	_, _, ok = l.Acquire(ClassDownload, "ip:192.0.2.1")
+	if !ok {
+		t.Errorf("Acquire() rejected after release")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"remote address", nil, false, "192.0.2.1"},
+		{"forwarded header ignored", []string{"203.0.113.7"}, false, "192.0.2.1"},
+		{"last forwarded address", []string{"198.51.100.1, 203.0.113.7"}, true, "203.0.113.7"},
+		{"last forwarded header", []string{"198.51.100.1", "203.0.113.7"}, true, "203.0.113.7"},
+		{"no forwarded header", nil, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+
+			if got := ClientIP(r, tt.trustProxy); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package dinghy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the size of the chunks streamed to clamd,
+// it has to stay below the StreamMaxLength of the daemon.
+const clamdChunkSize = 64 * 1024
+
+// Scanner checks files for malware using the INSTREAM command of a clamd compatible daemon.
+type Scanner struct {
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// ScanResult is the verdict of the scanner.
+type ScanResult struct {
+	Infected  bool
+	Signature string
+}
+
+// NewScanner creates a scanner for addresses like tcp://localhost:3310 or unix:///run/clamd.sock.
+func NewScanner(address string, timeout time.Duration) (*Scanner, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("parse clamd address %s: %v", address, err)
+	}
+
+	s := &Scanner{
+		Network: u.Scheme,
+		Timeout: timeout,
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		s.Address = u.Host
+	case "unix":
+		s.Address = u.Path
+	default:
+		return nil, fmt.Errorf("clamd address %s: scheme needs to be tcp or unix", address)
+	}
+
+	if s.Address == "" {
+		return nil, fmt.Errorf("clamd address %s: missing host or path", address)
+	}
+
+	return s, nil
+}
+
+// Scan streams r to clamd and returns its verdict.
+func (s *Scanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, s.Network, s.Address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("connect to clamd: %v", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("set deadline: %v", err)
+		}
+	}
+
+	err = stream(conn, r)
+	if err != nil {
+		// clamd closes the connection when the stream exceeds its limit, the reply tells why
+		reply, rerr := readReply(conn)
+		if rerr == nil && reply != "" {
+			return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+		}
+		return ScanResult{}, fmt.Errorf("stream to clamd: %v", err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("read clamd reply: %v", err)
+	}
+
+	return parseReply(reply)
+}
+
+func stream(w io.Writer, r io.Reader) error {
+	_, err := io.WriteString(w, "zINSTREAM\x00")
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+
+			_, werr := w.Write(buf[:4+n])
+			if werr != nil {
+				return werr
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read content: %v", err)
+		}
+	}
+
+	// a chunk of length zero terminates the stream
+	_, err = w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", err
+	}
+
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+func parseReply(reply string) (ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
@@ -0,0 +1,135 @@
+package dinghy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM commands, content containing the eicar test string is infected.
+func fakeClamd(t *testing.T, maxLength int) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				r := bufio.NewReader(conn)
+
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				content := []byte{}
+				for {
+					size := uint32(0)
+					err := binary.Read(r, binary.BigEndian, &size)
+					if err != nil {
+						return
+					}
+
+					if size == 0 {
+						break
+					}
+
+					chunk := make([]byte, size)
+					_, err = io.ReadFull(r, chunk)
+					if err != nil {
+						return
+					}
+
+					content = append(content, chunk...)
+					if len(content) > maxLength {
+						io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+						return
+					}
+				}
+
+				if bytes.Contains(content, []byte(eicar)) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+					return
+				}
+
+				io.WriteString(conn, "stream: OK\x00")
+			}(conn)
+		}
+	}()
+
+	return "tcp://" + l.Addr().String()
+}
+
+func TestScanner_Scan(t *testing.T) {
+	s, err := NewScanner(fakeClamd(t, 3*clamdChunkSize), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    ScanResult
+		wantErr bool
+	}{
+		{"empty", "", ScanResult{}, false},
+		{"clean", "hello world", ScanResult{}, false},
+		{"infected", eicar, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, false},
+		{"infected across chunks", strings.Repeat("a", clamdChunkSize-10) + eicar, ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, false},
+		{"too large", strings.Repeat("a", 4*clamdChunkSize), ScanResult{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Scan(context.Background(), strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Scanner.Scan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Scanner.Scan() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewScanner(t *testing.T) {
+	tests := []struct {
+		address     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{"tcp://clamd:3310", "tcp", "clamd:3310", false},
+		{"unix:///run/clamd.sock", "unix", "/run/clamd.sock", false},
+		{"http://clamd:3310", "", "", true},
+		{"tcp://", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := NewScanner(tt.address, time.Minute)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewScanner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (got.Network != tt.wantNetwork || got.Address != tt.wantAddress) {
+				t.Errorf("NewScanner() = %v, want %v %v", got, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client talks to the http api of the dinghy backend.
+type Client struct {
+	Endpoint   *url.URL
+	HTTPClient *http.Client
+	// Token is send as bearer token if set.
+	Token string
+	// Username and Password are send as basic auth if set.
+	Username string
+	Password string
+}
+
+// Directory is the json listing of a dinghy directory.
+type Directory struct {
+	Path        string
+	Directories []string
+	Files       []File
+}
+
+// File is a file entry of a directory listing.
+type File struct {
+	Name        string
+	Path        string
+	DownloadURL string
+	Size        int64
+	ETag        string `json:"ETag,omitempty"`
+	Icon        string
+	Thumbnail   string `json:"Thumbnail,omitempty"`
+	Archive     bool
+	ScanStatus  string `json:"ScanStatus,omitempty"`
+}
+
+// New creates a client for the backend reachable at endpoint.
+func New(endpoint string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse endpoint %s: %v", endpoint, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %s: scheme %s not supported", endpoint, u.Scheme)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return &Client{
+		Endpoint:   u,
+		HTTPClient: &http.Client{},
+	}, nil
+}
+
+func (c *Client) url(path string, query string) string {
+	u := *c.Endpoint
+	u.Path = u.Path + "/" + strings.TrimPrefix(path, "/")
+	u.RawQuery = query
+
+	return u.String()
+}
+
+func (c *Client) authorize(header http.Header) {
+	switch {
+	case c.Token != "":
+		header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "":
+		credentials := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path, query string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %v", err)
+	}
+
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	c.authorize(req.Header)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// List returns the listing of the directory at path.
+func (c *Client) List(ctx context.Context, path string) (Directory, error) {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+
+	resp, err := c.do(ctx, http.MethodGet, path, "", nil, header)
+	if err != nil {
+		return Directory{}, err
+	}
+	defer resp.Body.Close()
+
+	d := Directory{}
+
+	err = json.NewDecoder(resp.Body).Decode(&d)
+	if err != nil {
+		return Directory{}, fmt.Errorf("decode listing of %s: %v", path, err)
+	}
+
+	return d, nil
+}
+
+// Walk lists the directory at path and all its subdirectories.
+func (c *Client) Walk(ctx context.Context, path string, fn func(Directory) error) error {
+	d, err := c.List(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	err = fn(d)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range d.Directories {
+		err = c.Walk(ctx, "/"+d.Path+dir+"/", fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Download writes the content of the file at path to w.
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, path, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return fmt.Errorf("download %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// ContentSHA256 returns the sha256 sum of the file at path,
+// it is empty for files which were not uploaded through the backend.
+func (c *Client) ContentSHA256(ctx context.Context, path string) (string, error) {
+	resp, err := c.do(ctx, http.MethodHead, path, "", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("X-Content-Sha256"), nil
+}
+
+// Upload stores the content of r as file at path.
+func (c *Client) Upload(ctx context.Context, path string, r io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url(path, ""), r)
+	if err != nil {
+		return fmt.Errorf("create request: %v", err)
+	}
+
+	req.ContentLength = size
+	c.authorize(req.Header)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// policy violations are explained in the body
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if len(bytes.TrimSpace(msg)) > 0 {
+			return fmt.Errorf("upload %s: unexpected status %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+		}
+		return fmt.Errorf("upload %s: unexpected status %s", path, resp.Status)
+	}
+
+	return nil
+}
+
+// Delete removes the file at path.
+func (c *Client) Delete(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodDelete, path, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Watch streams the listing of the directory at path every time it changes.
+// The channel is closed when the connection ends or ctx is done.
+func (c *Client) Watch(ctx context.Context, path string) (<-chan Directory, error) {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	ws, err := c.dialWebsocket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ws.WriteMessage(websocket.TextMessage, []byte("cd "+path))
+	if err != nil {
+		ws.Close()
+		return nil, fmt.Errorf("change directory to %s: %v", path, err)
+	}
+
+	ch := make(chan Directory)
+
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+
+	go func() {
+		defer close(ch)
+		defer ws.Close()
+
+		for {
+			d := Directory{}
+
+			err := ws.ReadJSON(&d)
+			if err != nil {
+				return
+			}
+
+			select {
+			case ch <- d:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// RemoveRecursive removes the directory at path including all its content.
+func (c *Client) RemoveRecursive(ctx context.Context, path string) error {
+	ws, err := c.dialWebsocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	err = ws.WriteMessage(websocket.TextMessage, []byte("rm "+path))
+	if err != nil {
+		return fmt.Errorf("remove %s: %v", path, err)
+	}
+
+	// commands are processed in order, the listing arrives after the removal
+	err = ws.WriteMessage(websocket.TextMessage, []byte("cd "+parent(path)))
+	if err != nil {
+		return fmt.Errorf("change directory: %v", err)
+	}
+
+	d := Directory{}
+
+	err = ws.ReadJSON(&d)
+	if err != nil {
+		return fmt.Errorf("await removal of %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// extractQuiet is the time the extracted directory has to stay unchanged before an extraction counts as done.
+var extractQuiet = 5 * time.Second
+
+// Extract unpacks the archive at path next to it.
+// The server cancels the extraction when the connection ends, Extract keeps it open
+// until the extracted directory appeared and did not change for a while, or ctx is done.
+func (c *Client) Extract(ctx context.Context, path string) error {
+	ws, err := c.dialWebsocket(ctx)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+
+	dir := parent(path)
+
+	// the first listing tells which directories existed before
+	err = ws.WriteMessage(websocket.TextMessage, []byte("cd "+dir))
+	if err != nil {
+		return fmt.Errorf("change directory to %s: %v", dir, err)
+	}
+
+	before := Directory{}
+
+	err = ws.ReadJSON(&before)
+	if err != nil {
+		return fmt.Errorf("list %s: %v", dir, err)
+	}
+
+	err = ws.WriteMessage(websocket.TextMessage, []byte("ex "+path))
+	if err != nil {
+		return fmt.Errorf("extract %s: %v", path, err)
+	}
+
+	target := ""
+	for target == "" {
+		d := Directory{}
+
+		err = ws.ReadJSON(&d)
+		if err != nil {
+			return fmt.Errorf("await extraction of %s: %v", path, ctxErr(ctx, err))
+		}
+
+		target = newDirectory(before.Directories, d.Directories)
+	}
+
+	err = ws.WriteMessage(websocket.TextMessage, []byte("cd "+dir+target+"/"))
+	if err != nil {
+		return fmt.Errorf("change directory to %s: %v", dir+target, err)
+	}
+
+	for {
+		err = ws.SetReadDeadline(time.Now().Add(extractQuiet))
+		if err != nil {
+			return err
+		}
+
+		d := Directory{}
+
+		err = ws.ReadJSON(&d)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("await extraction of %s: %v", path, ctxErr(ctx, err))
+		}
+	}
+}
+
+// newDirectory returns the first directory of after missing in before.
+func newDirectory(before, after []string) string {
+	existing := map[string]bool{}
+	for _, d := range before {
+		existing[d] = true
+	}
+
+	for _, d := range after {
+		if !existing[d] {
+			return d
+		}
+	}
+
+	return ""
+}
+
+// ctxErr prefers the error of ctx over the error of the connection closed because of it.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func parent(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	return path[:strings.LastIndex(path, "/")+1]
+}
+
+func (c *Client) dialWebsocket(ctx context.Context) (*websocket.Conn, error) {
+	u := *c.Endpoint
+	u.Path += "/"
+
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		Jar:              c.HTTPClient.Jar,
+	}
+
+	header := http.Header{}
+	c.authorize(header)
+
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("connect websocket %s: %v (%s)", u.String(), err, resp.Status)
+		}
+		return nil, fmt.Errorf("connect websocket %s: %v", u.String(), err)
+	}
+
+	return ws, nil
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClient_Extract(t *testing.T) {
+	extractQuiet = 100 * time.Millisecond
+
+	listings := map[string][]Directory{
+		"cd /docs/": {{Path: "docs/", Directories: []string{"old"}}},
+		"ex /docs/a.zip": {
+			{Path: "docs/", Directories: []string{"old"}},
+			{Path: "docs/", Directories: []string{"a", "old"}},
+		},
+		"cd /docs/a/": {{Path: "docs/a/"}, {Path: "docs/a/", Files: []File{{Name: "b.txt"}}}},
+	}
+
+	received := make(chan []string, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+
+		commands := []string{}
+		defer func() { received <- commands }()
+
+		for {
+			_, m, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			commands = append(commands, string(m))
+
+			for _, d := range listings[string(m)] {
+				err = ws.WriteJSON(d)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = c.Extract(ctx, "/docs/a.zip")
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+
+	want := []string{"cd /docs/", "ex /docs/a.zip", "cd /docs/a/"}
+	if got := <-received; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %v, want %v", got, want)
+	}
+}
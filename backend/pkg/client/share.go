@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sharePrefix is the route of share links, it is reserved from the file paths.
+const sharePrefix = "/.dinghy/s/"
+
+// ShareRequest describes a share link to create.
+type ShareRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    string `json:"expiresIn,omitempty"`
+	Password     string `json:"password,omitempty"`
+	MaxDownloads int    `json:"maxDownloads,omitempty"`
+}
+
+// Share is an active share link.
+type Share struct {
+	Token        string    `json:"token"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Expires      time.Time `json:"expires"`
+	Protected    bool      `json:"protected"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+// CreateShare creates a share link. The url of the returned share is absolute.
+func (c *Client) CreateShare(ctx context.Context, req ShareRequest) (Share, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Share{}, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(ctx, http.MethodPost, sharePrefix, "", bytes.NewReader(body), header)
+	if err != nil {
+		return Share{}, err
+	}
+	defer resp.Body.Close()
+
+	share := Share{}
+
+	err = json.NewDecoder(resp.Body).Decode(&share)
+	if err != nil {
+		return Share{}, fmt.Errorf("decode share: %v", err)
+	}
+
+	share.URL = c.url(share.URL, "")
+
+	return share, nil
+}
+
+// Shares lists the active share links of the user.
+func (c *Client) Shares(ctx context.Context) ([]Share, error) {
+	resp, err := c.do(ctx, http.MethodGet, sharePrefix, "", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	shares := []Share{}
+
+	err = json.NewDecoder(resp.Body).Decode(&shares)
+	if err != nil {
+		return nil, fmt.Errorf("decode shares: %v", err)
+	}
+
+	for i := range shares {
+		shares[i].URL = c.url(shares[i].URL, "")
+	}
+
+	return shares, nil
+}
+
+// RevokeShare deletes a share link.
+func (c *Client) RevokeShare(ctx context.Context, token string) error {
+	resp, err := c.do(ctx, http.MethodDelete, sharePrefix+token, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,458 @@
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Sync mirrors a local directory to a dinghy directory or vice versa.
+type Sync struct {
+	Client *Client
+	// Local is the directory on the local file system.
+	Local string
+	// Remote is the directory of the dinghy backend, e.g. /photos/.
+	Remote string
+	// Upload mirrors Local to Remote, otherwise Remote is mirrored to Local.
+	Upload bool
+	// Delete removes files from the target missing in the source.
+	Delete bool
+	// DryRun only reports the changes.
+	DryRun bool
+	// Parallel is the number of concurrent transfers.
+	Parallel int
+	Out      io.Writer
+}
+
+type entry struct {
+	size int64
+	etag string
+}
+
+type action struct {
+	name string
+	op   string
+}
+
+// Run executes a single synchronisation pass.
+func (s *Sync) Run(ctx context.Context) error {
+	local, err := s.localFiles()
+	if err != nil {
+		return fmt.Errorf("scan local directory %s: %v", s.Local, err)
+	}
+
+	remote, err := s.remoteFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("scan remote directory %s: %v", s.Remote, err)
+	}
+
+	src, dst := local, remote
+	if !s.Upload {
+		src, dst = remote, local
+	}
+
+	actions := []action{}
+
+	for name, e := range src {
+		other, found := dst[name]
+		if found && s.equal(ctx, name, e, other) {
+			continue
+		}
+		actions = append(actions, action{name: name, op: "copy"})
+	}
+
+	if s.Delete {
+		for name := range dst {
+			if _, found := src[name]; !found {
+				actions = append(actions, action{name: name, op: "delete"})
+			}
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].name < actions[j].name
+	})
+
+	return s.execute(ctx, actions)
+}
+
+// equal reports if the local and the remote file have the same content.
+// The md5 sum of the local file is compared to the etag of the remote file,
+// multipart uploads and encrypted objects do not use it as etag, the sha256 sum recorded by the backend is compared instead.
+// Files without either are copied again.
+func (s *Sync) equal(ctx context.Context, name string, a, b entry) bool {
+	if a.size != b.size {
+		return false
+	}
+
+	remote := a
+	if s.Upload {
+		remote = b
+	}
+
+	localPath := filepath.Join(s.Local, filepath.FromSlash(name))
+
+	if isMD5(remote.etag) {
+		sum, err := hashFile(md5.New(), localPath)
+		if err != nil {
+			log.Printf("hash %s: %v", name, err)
+			return false
+		}
+
+		return sum == remote.etag
+	}
+
+	want, err := s.Client.ContentSHA256(ctx, s.Remote+name)
+	if err != nil {
+		log.Printf("sha256 of %s: %v", name, err)
+		return false
+	}
+
+	if want == "" {
+		return false
+	}
+
+	sum, err := hashFile(sha256.New(), localPath)
+	if err != nil {
+		log.Printf("hash %s: %v", name, err)
+		return false
+	}
+
+	return sum == want
+}
+
+func isMD5(etag string) bool {
+	if len(etag) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(etag)
+
+	return err == nil
+}
+
+func hashFile(h hash.Hash, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *Sync) execute(ctx context.Context, actions []action) error {
+	parallel := s.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	work := make(chan action)
+	errs := make(chan error, len(actions))
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range work {
+				err := s.apply(ctx, a)
+				if err != nil {
+					errs <- fmt.Errorf("%s %s: %v", a.op, a.name, err)
+				}
+			}
+		}()
+	}
+
+	for _, a := range actions {
+		work <- a
+	}
+	close(work)
+
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		log.Println(err)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", failed, len(actions))
+	}
+
+	return nil
+}
+
+func (s *Sync) apply(ctx context.Context, a action) error {
+	direction := "download"
+	if s.Upload {
+		direction = "upload"
+	}
+
+	if a.op == "copy" {
+		fmt.Fprintf(s.Out, "%s %s\n", direction, a.name)
+	} else {
+		fmt.Fprintf(s.Out, "delete %s\n", a.name)
+	}
+
+	if s.DryRun {
+		return nil
+	}
+
+	localPath := filepath.Join(s.Local, filepath.FromSlash(a.name))
+	remotePath := s.Remote + a.name
+
+	switch {
+	case a.op == "copy" && s.Upload:
+		return s.upload(ctx, localPath, remotePath)
+	case a.op == "copy":
+		return s.download(ctx, remotePath, localPath)
+	case s.Upload:
+		return s.Client.Delete(ctx, remotePath)
+	default:
+		return os.Remove(localPath)
+	}
+}
+
+func (s *Sync) upload(ctx context.Context, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(localPath))
+
+	return s.Client.Upload(ctx, remotePath, f, info.Size(), contentType)
+}
+
+func (s *Sync) download(ctx context.Context, remotePath, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".dinghy-sync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = s.Client.Download(ctx, remotePath, tmp)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), localPath)
+}
+
+func (s *Sync) localFiles() (map[string]entry, error) {
+	files := map[string]entry{}
+
+	err := os.MkdirAll(s.Local, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(s.Local, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".dinghy-sync-") {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.Local, path)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = entry{size: info.Size()}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (s *Sync) remoteFiles(ctx context.Context) (map[string]entry, error) {
+	files := map[string]entry{}
+
+	err := s.Client.Walk(ctx, s.Remote, func(d Directory) error {
+		for _, f := range d.Files {
+			name := strings.TrimPrefix(f.Path, s.Remote)
+			files[name] = entry{size: f.Size, etag: f.ETag}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Watch keeps both sides converged until ctx is done.
+// Local changes are detected with fsnotify, remote changes via the websocket
+// listing updates of the remote directory and a full pass every interval.
+func (s *Sync) Watch(ctx context.Context, interval time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch local directory: %v", err)
+	}
+	defer watcher.Close()
+
+	err = addRecursive(watcher, s.Local)
+	if err != nil {
+		return fmt.Errorf("watch local directory: %v", err)
+	}
+
+	remote := s.watchRemote(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	debounce := time.NewTimer(0)
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-debounce.C:
+			err := s.Run(ctx)
+			if err != nil {
+				log.Printf("sync: %v", err)
+			}
+
+		case <-ticker.C:
+			resetTimer(debounce, time.Second)
+
+		case <-remote:
+			resetTimer(debounce, time.Second)
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("local watcher closed")
+			}
+
+			if event.Has(fsnotify.Create) {
+				info, err := os.Stat(event.Name)
+				if err == nil && info.IsDir() {
+					err = addRecursive(watcher, event.Name)
+					if err != nil {
+						log.Printf("watch %s: %v", event.Name, err)
+					}
+				}
+			}
+
+			if !strings.HasPrefix(filepath.Base(event.Name), ".dinghy-sync-") {
+				resetTimer(debounce, time.Second)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("local watcher closed")
+			}
+			log.Printf("watch local directory: %v", err)
+		}
+	}
+}
+
+// resetTimer restarts t with d, dropping an expiry that was not received yet.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+
+	t.Reset(d)
+}
+
+func (s *Sync) watchRemote(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{})
+
+	go func() {
+		for {
+			updates, err := s.Client.Watch(ctx, s.Remote)
+			if err != nil {
+				log.Printf("watch remote directory: %v", err)
+			} else {
+				for range updates {
+					select {
+					case ch <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	return ch
+}
+
+func addRecursive(w *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return w.Add(path)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type remoteFile struct {
+	content string
+	etag    string
+	sha256  string
+}
+
+// fakeBackend serves the http api of the backend for files below the root directory.
+type fakeBackend struct {
+	mu      sync.Mutex
+	files   map[string]remoteFile
+	changes []string
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	path := r.URL.Path
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/"):
+		d := Directory{Path: strings.TrimPrefix(path, "/"), Directories: []string{}, Files: []File{}}
+		dirs := map[string]bool{}
+		for p, f := range b.files {
+			name := strings.TrimPrefix(p, path)
+			if len(name) == len(p) {
+				continue
+			}
+			if dir, _, found := strings.Cut(name, "/"); found {
+				if !dirs[dir] {
+					d.Directories = append(d.Directories, dir)
+				}
+				dirs[dir] = true
+				continue
+			}
+			d.Files = append(d.Files, File{Name: name, Path: p, Size: int64(len(f.content)), ETag: f.etag})
+		}
+		_ = json.NewEncoder(w).Encode(d)
+	case r.Method == http.MethodGet:
+		f, ok := b.files[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = io.WriteString(w, f.content)
+	case r.Method == http.MethodHead:
+		f, ok := b.files[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.sha256 != "" {
+			w.Header().Set("X-Content-Sha256", f.sha256)
+		}
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		b.files[path] = remoteFile{content: string(body), etag: md5Hex(string(body)), sha256: sha256Hex(string(body))}
+		b.changes = append(b.changes, "upload "+path)
+	case r.Method == http.MethodDelete:
+		delete(b.files, path)
+		b.changes = append(b.changes, "delete "+path)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSync_Run_upload(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  string
+		remote *remoteFile
+		delete bool
+		want   []string
+	}{
+		{
+			name:   "same content",
+			local:  "hello",
+			remote: &remoteFile{content: "hello", etag: md5Hex("hello")},
+			want:   []string{},
+		},
+		{
+			name:   "changed content of same size",
+			local:  "hallo",
+			remote: &remoteFile{content: "hello", etag: md5Hex("hello")},
+			want:   []string{"upload /docs/a.txt"},
+		},
+		{
+			name:   "multipart etag with same sha256",
+			local:  "hello",
+			remote: &remoteFile{content: "hello", etag: "0f343b0931126a20f133d67c2b018a3b-2", sha256: sha256Hex("hello")},
+			want:   []string{},
+		},
+		{
+			name:   "multipart etag with different sha256",
+			local:  "hallo",
+			remote: &remoteFile{content: "hello", etag: "0f343b0931126a20f133d67c2b018a3b-2", sha256: sha256Hex("hello")},
+			want:   []string{"upload /docs/a.txt"},
+		},
+		{
+			name:   "multipart etag without sha256",
+			local:  "hello",
+			remote: &remoteFile{content: "hello", etag: "0f343b0931126a20f133d67c2b018a3b-2"},
+			want:   []string{"upload /docs/a.txt"},
+		},
+		{
+			name:  "missing remote file",
+			local: "hello",
+			want:  []string{"upload /docs/a.txt"},
+		},
+		{
+			name:   "delete remote file missing locally",
+			remote: &remoteFile{content: "hello", etag: md5Hex("hello")},
+			delete: true,
+			want:   []string{"delete /docs/a.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &fakeBackend{files: map[string]remoteFile{}, changes: []string{}}
+			if tt.remote != nil {
+				backend.files["/docs/a.txt"] = *tt.remote
+			}
+
+			srv := httptest.NewServer(backend)
+			defer srv.Close()
+
+			local := t.TempDir()
+			if tt.local != "" {
+				err := os.WriteFile(filepath.Join(local, "a.txt"), []byte(tt.local), 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c, err := New(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Sync{Client: c, Local: local, Remote: "/docs/", Upload: true, Delete: tt.delete, Out: io.Discard}
+
+			err = s.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(backend.changes, tt.want) {
+				t.Errorf("changes = %v, want %v", backend.changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestSync_Run_download(t *testing.T) {
+	backend := &fakeBackend{files: map[string]remoteFile{
+		"/docs/a.txt":     {content: "hello", etag: md5Hex("hello")},
+		"/docs/sub/b.txt": {content: "world", etag: "0f343b0931126a20f133d67c2b018a3b-2", sha256: sha256Hex("world")},
+	}}
+
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	local := t.TempDir()
+	err := os.WriteFile(filepath.Join(local, "a.txt"), []byte("hallo"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(local, "stale.txt"), []byte("old"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Sync{Client: c, Local: local, Remote: "/docs/", Delete: true, Parallel: 2, Out: io.Discard}
+
+	err = s.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	got := map[string]string{}
+	err = filepath.WalkDir(local, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(local, path)
+		got[filepath.ToSlash(rel)] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a.txt": "hello", "sub/b.txt": "world"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("local files = %v, want %v", got, want)
+	}
+}
+
+func Test_resetTimer(t *testing.T) {
+	timer := time.NewTimer(0)
+	time.Sleep(10 * time.Millisecond)
+
+	// the expiry was not received, it must not fire the restarted timer early
+	resetTimer(timer, time.Hour)
+
+	select {
+	case <-timer.C:
+		t.Error("restarted timer fired immediately")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,108 @@
+package dinghy
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
+)
+
+// listenerQueue is the number of events a listener may fall behind before it has to relist.
+const listenerQueue = 64
+
+var (
+	hubListeners = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "notify_listeners",
+			Help: "Number of sessions sharing the subscription to the notify service.",
+		},
+	)
+	listenersResynced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "notify_listeners_resynced_total",
+			Help: "Count of sessions which fell behind and relist instead of receiving the missed events.",
+		},
+	)
+)
+
+// listener is a session receiving the events of the shared subscription.
+type listener struct {
+	c chan *pb.Event
+}
+
+// listen registers a listener receiving change events until the context is cancelled.
+// All listeners share a single subscription to notify, which ends with the last listener.
+// The queue of a listener falling behind is replaced by a single event without key, so that it relists.
+func (n *NotifyAdapter) listen(ctx context.Context) <-chan *pb.Event {
+	l := &listener{c: make(chan *pb.Event, listenerQueue)}
+
+	n.hubMu.Lock()
+	if len(n.listeners) == 0 {
+		hubCtx, cancel := context.WithCancel(context.Background())
+		n.listeners = map[*listener]struct{}{}
+		n.cancelHub = cancel
+
+		go n.fanOut(hubCtx, n.listenAfter(hubCtx, &pb.Event{}))
+	}
+	n.listeners[l] = struct{}{}
+	hubListeners.Inc()
+	n.hubMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		n.hubMu.Lock()
+		defer n.hubMu.Unlock()
+
+		delete(n.listeners, l)
+		hubListeners.Dec()
+
+		if len(n.listeners) == 0 {
+			n.cancelHub()
+		}
+	}()
+
+	return l.c
+}
+
+// fanOut passes the events of the shared subscription to all listeners without blocking.
+func (n *NotifyAdapter) fanOut(ctx context.Context, events <-chan *pb.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			n.hubMu.Lock()
+			// the listeners belong to the next subscription already
+			if ctx.Err() != nil {
+				n.hubMu.Unlock()
+				return
+			}
+
+			for l := range n.listeners {
+				l.send(e)
+			}
+			n.hubMu.Unlock()
+		}
+	}
+}
+
+// send queues the event, it is only called by the hub.
+func (l *listener) send(e *pb.Event) {
+	select {
+	case l.c <- e:
+		return
+	default:
+	}
+
+	listenersResynced.Inc()
+
+	for len(l.c) > 0 {
+		select {
+		case <-l.c:
+		default:
+		}
+	}
+
+	l.c <- &pb.Event{}
+}
@@ -0,0 +1,75 @@
+package dinghy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
+)
+
+// burstNotifier sends count events to every subscriber once start is closed.
+type burstNotifier struct {
+	pb.UnimplementedNotifierServer
+	start         chan struct{}
+	count         int
+	subscriptions int32
+}
+
+func (n *burstNotifier) Subscribe(in *pb.SubscribeRequest, stream pb.Notifier_SubscribeServer) error {
+	atomic.AddInt32(&n.subscriptions, 1)
+
+	<-n.start
+
+	for i := 1; i <= n.count; i++ {
+		err := stream.Send(&pb.Event{Stream: "s", Sequence: uint64(i), Key: fmt.Sprintf("files/%d.txt", i)})
+		if err != nil {
+			return err
+		}
+	}
+
+	<-stream.Context().Done()
+
+	return nil
+}
+
+func TestNotifyAdapter_listen_shared(t *testing.T) {
+	notifier := &burstNotifier{start: make(chan struct{}), count: 2 * listenerQueue}
+	n := notifyAdapter(t, notifier)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fast := n.listen(ctx)
+	slow := n.listen(ctx)
+	close(notifier.start)
+
+	for last := uint64(0); last != uint64(notifier.count); {
+		select {
+		case e := <-fast:
+			last = e.Sequence
+		case <-ctx.Done():
+			t.Fatalf("fast listener stopped at event %d", last)
+		}
+	}
+
+	if got := atomic.LoadInt32(&notifier.subscriptions); got != 1 {
+		t.Errorf("listeners made %d subscriptions", got)
+	}
+
+	// the slow listener did not read, its queue was replaced by a resync
+	select {
+	case e := <-slow:
+		if e.Key != "" {
+			t.Errorf("slow listener received %s, want an event without key", e.Key)
+		}
+	case <-ctx.Done():
+		t.Fatal("slow listener received nothing")
+	}
+
+	if len(slow) >= listenerQueue {
+		t.Errorf("slow listener has %d events queued", len(slow))
+	}
+}
@@ -0,0 +1,78 @@
+package dinghy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxKeyLength is the maximal length of an s3 object key in bytes.
+const maxKeyLength = 1024
+
+// reservedSegment is the top level directory of routes which are not files, like share links.
+// Files can not be stored below it, so that they do not collide with these routes.
+const reservedSegment = ".dinghy"
+
+// canonicalPath validates a user supplied path and returns its canonical form.
+// Every path used to build an object key has to pass through it.
+// Paths start with a slash, directories end with one.
+// Empty, "." and ".." segments, control characters and the reserved directory are rejected,
+// the path is normalized to unicode NFC.
+func canonicalPath(p string) (string, error) {
+	if !utf8.ValidString(p) {
+		return "", fmt.Errorf("path is not valid utf-8")
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("path needs to start with /")
+	}
+
+	p = norm.NFC.String(p)
+
+	if len(filesDirectory)+len(p) > maxKeyLength {
+		return "", fmt.Errorf("path exceeds %d bytes", maxKeyLength-len(filesDirectory))
+	}
+
+	for _, r := range p {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return "", fmt.Errorf("path contains control character %U", r)
+		}
+	}
+
+	segments := strings.Split(strings.TrimSuffix(p[1:], "/"), "/")
+	if p == "/" {
+		segments = nil
+	}
+
+	for _, s := range segments {
+		switch s {
+		case "":
+			return "", fmt.Errorf("path contains empty segment")
+		case ".", "..":
+			return "", fmt.Errorf("path contains %s segment", s)
+		}
+	}
+
+	if len(segments) > 0 && segments[0] == reservedSegment {
+		return "", fmt.Errorf("path is reserved")
+	}
+
+	return p, nil
+}
+
+// canonicalDirectory is canonicalPath for paths which need to be directories.
+func canonicalDirectory(p string) (string, error) {
+	p, err := canonicalPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasSuffix(p, "/") {
+		return "", fmt.Errorf("directory needs to end with /")
+	}
+
+	return p, nil
+}
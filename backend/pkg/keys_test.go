@@ -0,0 +1,94 @@
+package dinghy
+
+import (
+	"path"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func Test_canonicalPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "root", path: "/", want: "/"},
+		{name: "file", path: "/a/b.txt", want: "/a/b.txt"},
+		{name: "directory", path: "/a/b/", want: "/a/b/"},
+		{name: "spaces and symbols", path: "/a b/#?%&.txt", want: "/a b/#?%&.txt"},
+		{name: "dots in names", path: "/a/..b/c..", want: "/a/..b/c.."},
+		{name: "nfd to nfc", path: "/cafe\u0301", want: "/caf\u00e9"},
+		{name: "empty", path: "", wantErr: true},
+		{name: "relative", path: "a/b", wantErr: true},
+		{name: "parent segment", path: "/a/../b", wantErr: true},
+		{name: "parent at end", path: "/a/..", wantErr: true},
+		{name: "parent directory", path: "/../", wantErr: true},
+		{name: "current segment", path: "/a/./b", wantErr: true},
+		{name: "double slash", path: "/a//b", wantErr: true},
+		{name: "leading double slash", path: "//a", wantErr: true},
+		{name: "trailing double slash", path: "/a//", wantErr: true},
+		{name: "newline", path: "/a\nb", wantErr: true},
+		{name: "null byte", path: "/a\x00b", wantErr: true},
+		{name: "delete character", path: "/a\x7fb", wantErr: true},
+		{name: "invalid utf-8", path: "/a\xffb", wantErr: true},
+		{name: "reserved directory", path: "/.dinghy/s/", wantErr: true},
+		{name: "reserved name", path: "/.dinghy", wantErr: true},
+		{name: "reserved name below root", path: "/a/.dinghy/b", want: "/a/.dinghy/b"},
+		{name: "longest key", path: "/" + strings.Repeat("a", maxKeyLength-len(filesDirectory)-1), want: "/" + strings.Repeat("a", maxKeyLength-len(filesDirectory)-1)},
+		{name: "too long", path: "/" + strings.Repeat("a", maxKeyLength-len(filesDirectory)), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := canonicalPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("canonicalPath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("canonicalPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzCanonicalPath(f *testing.F) {
+	for _, seed := range []string{"/", "/a/b.txt", "/a/b/", "/a/../b", "//", "/a\x00", "/café/", "/\xff"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, p string) {
+		got, err := canonicalPath(p)
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(got, "/") {
+			t.Errorf("canonicalPath(%q) = %q does not start with /", p, got)
+		}
+
+		if !utf8.ValidString(got) || !norm.NFC.IsNormalString(got) {
+			t.Errorf("canonicalPath(%q) = %q is not valid NFC", p, got)
+		}
+
+		if len(filesDirectory+got) > maxKeyLength {
+			t.Errorf("canonicalPath(%q) = %q exceeds the key length", p, got)
+		}
+
+		if got != "/" && path.Clean(got) != strings.TrimSuffix(got, "/") {
+			t.Errorf("canonicalPath(%q) = %q is not clean", p, got)
+		}
+
+		if strings.HasSuffix(p, "/") != strings.HasSuffix(got, "/") {
+			t.Errorf("canonicalPath(%q) = %q changed the kind of path", p, got)
+		}
+
+		again, err := canonicalPath(got)
+		if err != nil || again != got {
+			t.Errorf("canonicalPath(%q) = %q, %v is not idempotent", got, again, err)
+		}
+	})
+}
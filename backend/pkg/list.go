@@ -2,9 +2,11 @@ package dinghy
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"log"
 	"mime"
@@ -13,10 +15,15 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
+	"time"
 
 	"gitlab.com/davedamoon/dinghy/backend/pkg/middleware"
 )
 
+// contentSHA256Key is the metadata key of the sha256 sum of uploaded files.
+const contentSHA256Key = "content-sha256"
+
 func (s *ServiceServer) get(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	ctx := r.Context()
@@ -30,6 +37,11 @@ func (s *ServiceServer) get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if middleware.IsEventStream(r) {
+		s.serveEvents(w, r)
+		return
+	}
+
 	found, etag, contentType, err := s.Storage.exists(ctx, filesDirectory+path)
 	if err != nil {
 		log.Printf("GET %s: %v", path, err)
@@ -38,7 +50,11 @@ func (s *ServiceServer) get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if found && path != "/" {
-		err = s.download(ctx, etag, contentType, w, r)
+		if s.rejectUnscanned(w, r, path) {
+			return
+		}
+
+		err = s.download(ctx, path, etag, contentType, true, w, r)
 		if err != nil {
 			log.Printf("GET %s: %v", path, err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -58,8 +74,43 @@ func (s *ServiceServer) get(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotFound)
 }
 
-func (s *ServiceServer) download(ctx context.Context, etag, contentType string, w http.ResponseWriter, r *http.Request) error {
-	path := filesDirectory + r.URL.Path
+// head answers with the headers of the file at path.
+// X-Content-Sha256 carries the sha256 sum of files uploaded through the backend,
+// it allows clients to compare content when the etag is not the md5 sum.
+func (s *ServiceServer) head(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	ctx := r.Context()
+
+	found, etag, contentType, err := s.Storage.exists(ctx, filesDirectory+path)
+	if err != nil {
+		log.Printf("HEAD %s: %v", path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !found || strings.HasSuffix(path, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	metadata, err := s.Storage.metadata(ctx, filesDirectory+path)
+	if err != nil {
+		log.Printf("HEAD %s: %v", path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	if metadata[contentSHA256Key] != "" {
+		w.Header().Set("X-Content-Sha256", metadata[contentSHA256Key])
+	}
+}
+
+// download delivers the file at filePath, the thumbnail of it or a redirect to the storage.
+// Without allowRedirect the file is delivered directly, scriptable documents as attachment.
+func (s *ServiceServer) download(ctx context.Context, filePath, etag, contentType string, allowRedirect bool, w http.ResponseWriter, r *http.Request) error {
+	path := filesDirectory + filePath
 
 	redirect, thumbnail, err := parseRequest(r.URL.RawQuery)
 	if err != nil {
@@ -67,13 +118,14 @@ func (s *ServiceServer) download(ctx context.Context, etag, contentType string,
 	}
 
 	if thumbnail {
-		path, err = s.prepareThumbnail(ctx, etag, r.URL.Path)
+		path, err = s.prepareThumbnail(ctx, etag, filePath)
 		if err != nil {
 			return fmt.Errorf("GET %s: prepare thumbnail: %v", path, err)
 		}
+		contentType = "image/png"
 	}
 
-	if redirect {
+	if redirect && allowRedirect {
 		url, err := s.Storage.presign(r.Context(), http.MethodGet, path)
 		if err != nil {
 			return fmt.Errorf("GET %s: presign: %v", path, err)
@@ -83,7 +135,18 @@ func (s *ServiceServer) download(ctx context.Context, etag, contentType string,
 		return nil
 	}
 
-	w.Header().Add("Content-Type", contentType)
+	isolated := s.UserContent.handles(r)
+	if allowRedirect && s.UserContent != nil && !isolated && scriptable(contentType) {
+		url, err := s.UserContent.sign(filePath, userFromContext(ctx), time.Now())
+		if err != nil {
+			return fmt.Errorf("GET %s: sign user content url: %v", path, err)
+		}
+
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		return nil
+	}
+
+	contentHeaders(w.Header(), filePath, contentType, isolated)
 
 	err = s.delieverFile(r.Context(), path, w)
 	if err != nil {
@@ -146,11 +209,13 @@ func (s *ServiceServer) delete(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		s.audit(r, AuditDelete, path, 0, AuditRedirected, nil)
 		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 		return
 	}
 
 	err = s.Storage.delete(r.Context(), filesDirectory+path)
+	s.audit(r, AuditDelete, path, 0, auditResult(err), err)
 	if err != nil {
 		log.Printf("DELETE %s: %v", path, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -165,7 +230,20 @@ func (s *ServiceServer) put(w http.ResponseWriter, r *http.Request) {
 		log.Printf("PUT %s: check redirect: %v", path, err)
 	}
 
-	if redirect {
+	rule := s.Uploads.rule(path)
+
+	err = rule.checkName(path)
+	if err == nil && r.ContentLength > 0 {
+		err = rule.checkSize(r.ContentLength)
+	}
+	if err != nil {
+		s.audit(r, AuditUpload, path, r.ContentLength, AuditRejected, err)
+		rejectUpload(w, r, err)
+		return
+	}
+
+	// presigned urls can not limit size or content, restricted and scanned uploads are received here instead
+	if redirect && !rule.restrictsContent() && s.Scanner == nil {
 		url, err := s.Storage.presign(r.Context(), http.MethodPut, filesDirectory+path)
 		if err != nil {
 			log.Printf("PUT %s: redirect: %v", path, err)
@@ -173,59 +251,99 @@ func (s *ServiceServer) put(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		s.audit(r, AuditUpload, path, r.ContentLength, AuditRedirected, nil)
 		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 		return
 	}
 
-	err = s.receiveFile(r.Context(), filesDirectory+path, r)
+	size, err := s.receiveFile(r.Context(), path, rule, r)
+	s.audit(r, AuditUpload, path, size, auditResult(err), err)
 	if err != nil {
-		log.Printf("PUT %s: receive file: %v", path, err)
-		w.WriteHeader(http.StatusInternalServerError)
+		rejectUpload(w, r, err)
+		return
+	}
+}
+
+// rejectUpload responds with the status of policy violations, other errors are internal.
+func rejectUpload(w http.ResponseWriter, r *http.Request, err error) {
+	uerr := uploadError{}
+	if errors.As(err, &uerr) {
+		log.Printf("PUT %s: rejected: %v", r.URL.Path, err)
+		http.Error(w, uerr.msg, uerr.status)
 		return
 	}
+
+	log.Printf("PUT %s: receive file: %v", r.URL.Path, err)
+	w.WriteHeader(http.StatusInternalServerError)
 }
 
-func (s *ServiceServer) receiveFile(ctx context.Context, path string, r *http.Request) error {
+// receiveFile stores the body of the request and returns its size.
+func (s *ServiceServer) receiveFile(ctx context.Context, filePath string, rule *UploadRule, r *http.Request) (int64, error) {
 	tmpfile, err := os.CreateTemp("", "s3_upload")
 	if err != nil {
-		return fmt.Errorf("create temp file: %v", err)
+		return 0, fmt.Errorf("create temp file: %v", err)
 	}
 	defer os.Remove(tmpfile.Name())
 
-	_, err = io.Copy(tmpfile, r.Body)
+	body := io.Reader(r.Body)
+	if rule != nil && rule.MaxSize > 0 {
+		// one byte more than allowed reveals too large files without reading them completely
+		body = io.LimitReader(r.Body, rule.MaxSize+1)
+	}
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(tmpfile, hash), body)
 	if err != nil {
-		return fmt.Errorf("write local temp file: %v", err)
+		return size, fmt.Errorf("write local temp file: %v", err)
 	}
 
 	_, err = tmpfile.Seek(0, 0)
 	if err != nil {
-		return fmt.Errorf("seek temp file: %v", err)
+		return size, fmt.Errorf("seek temp file: %v", err)
 	}
 
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
-		extention := filepath.Ext(path)
+		extention := filepath.Ext(filePath)
 		contentType = mime.TypeByExtension(extention)
 	}
 
-	err = s.Storage.upload(ctx, path, tmpfile, contentType)
+	err = rule.check(filePath, tmpfile, size, contentType)
 	if err != nil {
-		return fmt.Errorf("upload: %v", err)
+		return size, err
 	}
 
-	s.Notify.notify(ctx)
+	metadata, err := s.scan(ctx, filePath, tmpfile, contentType)
+	if err != nil {
+		return size, err
+	}
 
-	return nil
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[contentSHA256Key] = hex.EncodeToString(hash.Sum(nil))
+
+	err = s.Storage.upload(ctx, filesDirectory+filePath, tmpfile, contentType, metadata)
+	if err != nil {
+		return size, fmt.Errorf("upload: %v", err)
+	}
+
+	s.notifyChange(ctx, eventCreated, filePath, size)
+
+	return size, nil
 }
 
 func (s *ServiceServer) list(w http.ResponseWriter, r *http.Request) error {
 	path := r.URL.Path
 
-	l, err := s.Storage.list(r.Context(), path)
+	l, err := s.listing(r.Context(), path)
 	if err != nil {
 		return fmt.Errorf("list %s: %v", path, err)
 	}
 
+	l = s.Policy.filter(userFromContext(r.Context()), l)
+
 	err = respond(w, r, l, s.FrontendURL)
 	if err != nil {
 		return fmt.Errorf("respond: %v", err)
@@ -244,7 +362,10 @@ func respond(w http.ResponseWriter, r *http.Request, l Directory, frontendURL st
 		return nil
 	}
 
-	if isCLIClient(r.UserAgent()) {
+	if isCLIClient(r.UserAgent()) || frontendURL == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
 		err := l.toTXT(w)
 		if err != nil {
 			return fmt.Errorf("render text: %v", err)
@@ -253,7 +374,7 @@ func respond(w http.ResponseWriter, r *http.Request, l Directory, frontendURL st
 		return nil
 	}
 
-	http.Redirect(w, r, frontendURL+r.URL.Path, http.StatusTemporaryRedirect)
+	http.Redirect(w, r, frontendURL+escapePath(r.URL.Path), http.StatusTemporaryRedirect)
 
 	return nil
 }
@@ -1,7 +1,11 @@
 package dinghy
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -13,6 +17,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -51,6 +56,30 @@ func (m MinioAdapter) exists(ctx context.Context, path string) (bool, string, st
 	return false, "", "", fmt.Errorf("stat object %s: %v", path, err)
 }
 
+// metadata returns the user metadata of an object with lower case keys.
+func (m MinioAdapter) metadata(ctx context.Context, path string) (map[string]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: object metadata")
+	defer span.Finish()
+
+	span.LogFields(log.String("path", path))
+
+	head, err := m.Client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return nil, fmt.Errorf("stat object %s: %v", path, err)
+	}
+
+	metadata := map[string]string{}
+	for k, v := range head.Metadata {
+		metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	return metadata, nil
+}
+
 type Directory struct {
 	Path        string
 	Directories []string
@@ -62,9 +91,11 @@ type File struct {
 	Path        string
 	DownloadURL string
 	Size        int64
+	ETag        string `json:"ETag,omitempty"`
 	Icon        string
 	Thumbnail   string `json:"Thumbnail,omitempty"`
 	Archive     bool
+	ScanStatus  string `json:"ScanStatus,omitempty"`
 }
 
 type byFileName []File
@@ -118,24 +149,23 @@ func (m MinioAdapter) list(ctx context.Context, prefix string) (Directory, error
 		for _, object := range page.Contents {
 			name := strings.TrimPrefix(*object.Key, filesDirectory+prefix)
 
-			redirect := ""
+			flags := []string{}
 			if shouldUsePresignRedirect(name) {
-				redirect = "?redirect"
+				flags = append(flags, "redirect")
 			}
 
-			url := strings.TrimPrefix(*object.Key+redirect, filesDirectory+"/")
-
 			file := File{
 				Name:        name,
 				Path:        prefix + name,
 				Size:        *object.Size,
-				DownloadURL: url,
+				ETag:        strings.Trim(aws.StringValue(object.ETag), "\""),
+				DownloadURL: fileURL(prefix+name, flags...),
 				Icon:        icon(name),
 				Archive:     canBeExtracted(name, l.Directories),
 			}
 
 			if thumbnailSupported(name) {
-				file.Thumbnail = url + "&thumbnail"
+				file.Thumbnail = fileURL(prefix+name, append(flags, "thumbnail")...)
 			}
 
 			l.Files = append(l.Files, file)
@@ -238,35 +268,41 @@ func (m MinioAdapter) delete(ctx context.Context, path string) error {
 	return nil
 }
 
-func (m MinioAdapter) deleteRecursive(ctx context.Context, prefix string) error {
+// deleteRecursive deletes the file at path and everything below path + "/".
+// Directories may be given with or without trailing slash.
+func (m MinioAdapter) deleteRecursive(ctx context.Context, path string) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: delete recursive")
 	defer span.Finish()
 
 	span.LogFields(
-		log.String("path", prefix),
+		log.String("path", path),
 	)
 
-	ls, err := m.Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket: aws.String(m.Bucket),
-		Prefix: aws.String(strings.TrimPrefix(filesDirectory, "/") + prefix),
-	})
+	file := filesDirectory + strings.TrimSuffix(path, "/")
+	dir := file + "/"
+
+	keys, err := m.listKeys(ctx, file)
 	if err != nil {
 		span.LogFields(log.Error(err))
-		return fmt.Errorf("list %s: %v", prefix, err)
+		return err
 	}
 
-	for _, object := range ls.Contents {
-		err = m.delete(ctx, *object.Key)
+	for _, key := range keys {
+		if key != file && !strings.HasPrefix(key, dir) {
+			continue
+		}
+
+		err = m.delete(ctx, key)
 		if err != nil {
 			span.LogFields(log.Error(err))
-			return fmt.Errorf("delete %s: %v", *object.Key, err)
+			return fmt.Errorf("delete %s: %v", key, err)
 		}
 	}
 
 	return nil
 }
 
-func (m MinioAdapter) upload(ctx context.Context, path string, file io.ReadSeeker, contentType string) error {
+func (m MinioAdapter) upload(ctx context.Context, path string, file io.ReadSeeker, contentType string, metadata map[string]string) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: upload")
 	defer span.Finish()
 
@@ -284,6 +320,10 @@ func (m MinioAdapter) upload(ctx context.Context, path string, file io.ReadSeeke
 		put.ContentType = aws.String(contentType)
 	}
 
+	if len(metadata) > 0 {
+		put.Metadata = aws.StringMap(metadata)
+	}
+
 	_, err := m.Client.PutObjectWithContext(ctx, put)
 	if err != nil {
 		span.LogFields(log.Error(err))
@@ -293,17 +333,29 @@ func (m MinioAdapter) upload(ctx context.Context, path string, file io.ReadSeeke
 	return nil
 }
 
-func (m MinioAdapter) uploadRecursive(ctx context.Context, src, target string) error {
+// uploadRecursive uploads the files below the local directory src to the directory target.
+// It fails on files which do not map to a valid path.
+func (m MinioAdapter) uploadRecursive(ctx context.Context, src, target string, metadata map[string]string) error {
 	return filepath.Walk(src,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
 
-			if info.IsDir() {
+			if !info.Mode().IsRegular() {
 				return nil
 			}
 
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+
+			key, err := canonicalPath(target + filepath.ToSlash(rel))
+			if err != nil {
+				return fmt.Errorf("file %s: %v", rel, err)
+			}
+
 			file, err := os.Open(path)
 			if err != nil {
 				return err
@@ -313,7 +365,7 @@ func (m MinioAdapter) uploadRecursive(ctx context.Context, src, target string) e
 			extention := filepath.Ext(path)
 			contentType := mime.TypeByExtension(extention)
 
-			err = m.upload(ctx, target+strings.TrimPrefix(path, src), file, contentType)
+			err = m.upload(ctx, filesDirectory+key, file, contentType, metadata)
 			if err != nil {
 				return err
 			}
@@ -343,3 +395,176 @@ func (m MinioAdapter) download(ctx context.Context, path string, w io.WriterAt)
 
 	return nil
 }
+
+func (m MinioAdapter) getObject(ctx context.Context, path string) ([]byte, error) {
+	buf := aws.NewWriteAtBuffer([]byte{})
+
+	err := m.download(ctx, path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (m MinioAdapter) putObject(ctx context.Context, path string, b []byte, contentType string) error {
+	return m.upload(ctx, path, bytes.NewReader(b), contentType, nil)
+}
+
+// errModified is returned by conditional writes to objects which changed since they were read.
+var errModified = errors.New("object modified concurrently")
+
+// getObjectETag returns the content of a small object together with its etag.
+func (m MinioAdapter) getObjectETag(ctx context.Context, path string) ([]byte, string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: get object")
+	defer span.Finish()
+
+	span.LogFields(log.String("path", path))
+
+	out, err := m.Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(m.Bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return nil, "", fmt.Errorf("get object %s: %v", path, err)
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("read object %s: %v", path, err)
+	}
+
+	return b, aws.StringValue(out.ETag), nil
+}
+
+// putObjectIfMatch replaces an object only if its etag is unchanged, it returns errModified otherwise.
+func (m MinioAdapter) putObjectIfMatch(ctx context.Context, path string, b []byte, contentType, etag string) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: conditional put")
+	defer span.Finish()
+
+	span.LogFields(log.String("path", path))
+
+	_, err := m.Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(m.Bucket),
+		Key:         aws.String(path),
+		Body:        bytes.NewReader(b),
+		ContentType: aws.String(contentType),
+	}, request.WithSetRequestHeaders(map[string]string{"If-Match": etag}))
+
+	if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusPreconditionFailed {
+		return errModified
+	}
+
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return fmt.Errorf("put object %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// listETags returns the etags of all objects below the prefix by key.
+func (m MinioAdapter) listETags(ctx context.Context, prefix string) (map[string]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: list etags")
+	defer span.Finish()
+
+	span.LogFields(log.String("prefix", prefix))
+
+	etags := map[string]string{}
+
+	err := m.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			etags[aws.StringValue(object.Key)] = aws.StringValue(object.ETag)
+		}
+		return true
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return nil, fmt.Errorf("list %s: %v", prefix, err)
+	}
+
+	return etags, nil
+}
+
+func (m MinioAdapter) listKeys(ctx context.Context, prefix string) ([]string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: list keys")
+	defer span.Finish()
+
+	span.LogFields(log.String("prefix", prefix))
+
+	keys := []string{}
+
+	err := m.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, *object.Key)
+		}
+		return true
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return nil, fmt.Errorf("list %s: %v", prefix, err)
+	}
+
+	return keys, nil
+}
+
+// hasPrefix reports if at least one object starts with the prefix.
+func (m MinioAdapter) hasPrefix(ctx context.Context, prefix string) (bool, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: check prefix")
+	defer span.Finish()
+
+	span.LogFields(log.String("prefix", prefix))
+
+	out, err := m.Client.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(m.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return false, fmt.Errorf("list %s: %v", prefix, err)
+	}
+
+	return len(out.Contents) > 0, nil
+}
+
+// etagHash returns a hash of the names and etags of the entries of the directory.
+// It changes with the content of the directory and is cheaper to get than the listing.
+func (m MinioAdapter) etagHash(ctx context.Context, prefix string) (string, error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "s3: hash prefix")
+	defer span.Finish()
+
+	span.LogFields(log.String("prefix", prefix))
+
+	h := sha256.New()
+
+	err := m.Client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(m.Bucket),
+		Prefix:    aws.String(strings.TrimPrefix(filesDirectory, "/") + prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			fmt.Fprintf(h, "%s\n", aws.StringValue(p.Prefix))
+		}
+
+		for _, object := range page.Contents {
+			fmt.Fprintf(h, "%s %s\n", aws.StringValue(object.Key), aws.StringValue(object.ETag))
+		}
+
+		return true
+	})
+	if err != nil {
+		span.LogFields(log.Error(err))
+		return "", fmt.Errorf("list %s: %v", prefix, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
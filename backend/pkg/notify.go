@@ -3,45 +3,446 @@ package dinghy
 import (
 	"context"
 	"log"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
 )
 
+var (
+	relistsCoalesced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "relists_coalesced_total",
+			Help: "Count of changes merged into a pending relist of a watched directory.",
+		},
+	)
+	notifyCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "notify_calls_total",
+			Help: "Count of calls to the notify service by result, open when skipped by the circuit breaker.",
+		},
+		[]string{"call", "result"},
+	)
+	notifyAvailable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "notify_available",
+			Help: "1 if the notify service is reachable, 0 while watched directories are polled.",
+		},
+	)
+)
+
+// RegisterMetrics registers the metrics of the service.
+func RegisterMetrics(r prometheus.Registerer) error {
+	notifyAvailable.Set(1)
+
+	for _, c := range []prometheus.Collector{relistsCoalesced, notifyCalls, notifyAvailable, hubListeners, listenersResynced, auditDropped} {
+		err := r.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// names of the s3 events sent along with notifications
+const (
+	eventCreated = "s3:ObjectCreated:Put"
+	eventRemoved = "s3:ObjectRemoved:Delete"
+)
+
+const (
+	// retryDelay is the delay before resubscribing to notify, it doubles with every failure.
+	retryDelay    = time.Second
+	retryMaxDelay = time.Minute
+	// breakerThreshold is the number of consecutive failures opening the circuit breaker.
+	breakerThreshold = 3
+	// breakerCooldown is the time between two calls while the breaker is open.
+	breakerCooldown = 15 * time.Second
+	// defaultPollInterval is the interval watched directories are polled at while notify is unavailable.
+	defaultPollInterval = 10 * time.Second
+)
+
+// NotifyAdapter exchanges change events with the notify service.
+// After repeated failures a circuit breaker stops calling it,
+// until it is reachable again watched directories are polled instead.
 type NotifyAdapter struct {
 	NotifierClient pb.NotifierClient
+	// PollInterval is the interval watched directories are polled at while notify is unavailable.
+	PollInterval time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// next is the time the open breaker lets the next call pass.
+	next time.Time
+
+	// listeners share the subscription of the hub
+	hubMu     sync.Mutex
+	listeners map[*listener]struct{}
+	cancelHub context.CancelFunc
+}
+
+// Available reports if notify is reachable, otherwise watched directories need to be polled.
+func (n *NotifyAdapter) Available() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.failures < breakerThreshold
+}
+
+func (n *NotifyAdapter) pollInterval() time.Duration {
+	if n.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+
+	return n.PollInterval
+}
+
+// allow reports if a call may be made, the open breaker lets a single call pass per cooldown.
+func (n *NotifyAdapter) allow() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.failures < breakerThreshold {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(n.next) {
+		return false
+	}
+	n.next = now.Add(breakerCooldown)
+
+	return true
+}
+
+// result records the outcome of a call.
+func (n *NotifyAdapter) result(call string, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err == nil {
+		if n.failures >= breakerThreshold {
+			log.Printf("notify is available again")
+		}
+
+		notifyCalls.WithLabelValues(call, "ok").Inc()
+		notifyAvailable.Set(1)
+		n.failures = 0
+
+		return
+	}
+
+	notifyCalls.WithLabelValues(call, "error").Inc()
+
+	n.failures++
+	if n.failures == breakerThreshold {
+		log.Printf("notify is unavailable, polling watched directories: %v", err)
+		notifyAvailable.Set(0)
+		n.next = time.Now().Add(breakerCooldown)
+	}
 }
 
-func (n *NotifyAdapter) notify(ctx context.Context) {
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
+func (n *NotifyAdapter) notify(ctx context.Context, e *pb.Event) {
+	if !n.allow() {
+		notifyCalls.WithLabelValues("notify", "open").Inc()
+		return
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	_, err := n.NotifierClient.Notify(ctx, &pb.Request{})
+	_, err := n.NotifierClient.Notify(callCtx, &pb.Request{Event: e})
 	if err != nil {
 		log.Printf("could not notify: %v", err)
 	}
+
+	// the caller gave up, notify did not fail
+	if ctx.Err() != nil {
+		return
+	}
+
+	n.result("notify", err)
 }
 
-func (n *NotifyAdapter) listen(ctx context.Context) <-chan struct{} {
-	ch := make(chan struct{})
+// listenAfter streams the events following last, which needs stream and sequence number.
+// After an interruption the subscription resumes after the last received event,
+// notify sends a gap event without key if it can not replay the missed ones,
+// like when the connection switched to another replica.
+// Failed subscriptions are retried with exponential backoff.
+func (n *NotifyAdapter) listenAfter(ctx context.Context, last *pb.Event) <-chan *pb.Event {
+	ch := make(chan *pb.Event)
+
+	send := func(e *pb.Event) bool {
+		last = e
+
+		select {
+		case ch <- e:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	go func() {
+		resync := false
+		failures := 0
+
 		for {
-			_, err := n.NotifierClient.Listen(ctx, &pb.Request{})
+			if n.allow() {
+				connected, err := n.subscribe(ctx, last, resync, send)
+				if ctx.Err() != nil {
+					return
+				}
+
+				if connected {
+					failures = 0
+					resync = false
+				}
+
+				log.Printf("could not listen: %v", err)
+
+				// without a received event there is nothing to resume from
+				resync = resync || last.Sequence == 0
+			} else {
+				notifyCalls.WithLabelValues("subscribe", "open").Inc()
+			}
 
 			select {
 			case <-ctx.Done():
 				return
-			default:
+			case <-time.After(backoff(failures)):
 			}
 
-			if err != nil {
-				log.Printf("could not listen: %v", err)
-				time.Sleep(time.Second)
-			}
-
-			ch <- struct{}{}
+			failures++
 		}
 	}()
 
 	return ch
 }
+
+// backoff returns the delay after the given number of failures,
+// randomized so that clients do not retry all at once.
+func backoff(failures int) time.Duration {
+	d := retryMaxDelay
+	if failures < 16 {
+		d = retryDelay << failures
+	}
+
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// subscribe passes the events following last to send until the stream ends.
+// If resync is set an event without key is sent once connected, as events may have been missed.
+// It reports if the subscription was established.
+func (n *NotifyAdapter) subscribe(ctx context.Context, last *pb.Event, resync bool, send func(*pb.Event) bool) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := n.NotifierClient.Subscribe(ctx, &pb.SubscribeRequest{After: last.Sequence, Stream: last.Stream})
+	if err == nil {
+		// notify sends the header once subscribed
+		_, err = stream.Header()
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	n.result("subscribe", err)
+	if err != nil {
+		return false, err
+	}
+
+	if resync && !send(&pb.Event{}) {
+		return true, ctx.Err()
+	}
+
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			return true, err
+		}
+
+		if !send(e) {
+			return true, ctx.Err()
+		}
+	}
+}
+
+// notifyChange tells other backends about the change of a file.
+func (s *ServiceServer) notifyChange(ctx context.Context, name, filePath string, size int64) {
+	s.Notify.notify(ctx, &pb.Event{
+		Bucket: s.Storage.Bucket,
+		Key:    filesDirectory + filePath,
+		Name:   name,
+		Size:   size,
+	})
+}
+
+// changedEntry tells if the event changes the content below the directory dir.
+// If the changed object is not a direct child, entry is the subdirectory of dir containing it.
+// Events without key may have changed anything.
+func changedEntry(e *pb.Event, dir string) (entry string, affected bool) {
+	if e.GetKey() == "" {
+		return "", true
+	}
+
+	if !strings.HasPrefix(e.Key, filesDirectory+"/") {
+		return "", false
+	}
+
+	rest := strings.TrimPrefix(e.Key, filesDirectory+dir)
+	if len(rest) == len(e.Key) || rest == "" {
+		return "", false
+	}
+
+	entry, _, found := strings.Cut(rest, "/")
+	if !found || rest == entry+"/" {
+		// a file or directory marker directly below dir
+		return "", true
+	}
+
+	return entry, true
+}
+
+// wakes reports if the event may change the listing of dir, previous is the listing last sent.
+// Changes deeper below dir only matter if they make a subdirectory appear or disappear,
+// check names a listed subdirectory which needs to be looked up before relisting, as it may still have content.
+func wakes(e *pb.Event, dir string, previous *Directory) (wake bool, check string) {
+	entry, affected := changedEntry(e, dir)
+	if !affected {
+		return false, ""
+	}
+
+	if entry == "" || previous == nil {
+		return true, ""
+	}
+
+	listed := false
+	for _, d := range previous.Directories {
+		if d == entry {
+			listed = true
+			break
+		}
+	}
+
+	if !strings.HasPrefix(e.Name, "s3:ObjectRemoved:") {
+		return !listed, ""
+	}
+
+	if !listed {
+		return false, ""
+	}
+
+	return true, entry
+}
+
+// relistThrottle allows a session one relist per interval,
+// changes within the interval are merged into a relist at its end.
+type relistThrottle struct {
+	interval time.Duration
+	last     time.Time
+	timer    *time.Timer
+	// C receives when a merged relist is due, it is nil if none is pending.
+	C <-chan time.Time
+
+	// changed is set if the merged changes need a relist in any case,
+	// otherwise only subdirectories in checks may have disappeared.
+	changed bool
+	checks  map[string]struct{}
+}
+
+// wake merges a change and reports if the directory is relisted now, otherwise the relist is scheduled.
+// A change with check only needs a relist if the subdirectory check turns out empty.
+func (t *relistThrottle) wake(check string) bool {
+	if check == "" {
+		t.changed = true
+	} else {
+		if t.checks == nil {
+			t.checks = map[string]struct{}{}
+		}
+		t.checks[check] = struct{}{}
+	}
+
+	if t.C != nil {
+		relistsCoalesced.Inc()
+		return false
+	}
+
+	wait := t.interval - time.Since(t.last)
+	if wait <= 0 {
+		return true
+	}
+
+	t.timer = time.NewTimer(wait)
+	t.C = t.timer.C
+
+	return false
+}
+
+// listed records a relist, a scheduled one is cancelled.
+func (t *relistThrottle) listed() {
+	t.last = time.Now()
+	t.changed = false
+	t.checks = nil
+	t.stop()
+}
+
+func (t *relistThrottle) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+		t.C = nil
+	}
+}
+
+// relistNeeded looks up the subdirectories merged by the throttle once per relist.
+// If all of them still have content the relist is skipped and counted as done.
+func (s *ServiceServer) relistNeeded(ctx context.Context, dir string, t *relistThrottle) bool {
+	if t.changed || len(t.checks) == 0 {
+		return true
+	}
+
+	for entry := range t.checks {
+		found, err := s.Storage.hasPrefix(ctx, filesDirectory+dir+entry+"/")
+		if err != nil {
+			log.Printf("check %s%s/: %v", dir, entry, err)
+			return true
+		}
+
+		if !found {
+			return true
+		}
+	}
+
+	t.listed()
+
+	return false
+}
+
+// polledChange reports if the directory changed since the last poll while notify is unavailable,
+// hash keeps the state of the directory between polls.
+func (s *ServiceServer) polledChange(ctx context.Context, dir string, hash *string) bool {
+	if s.Notify.Available() {
+		// the first poll of the next outage relists
+		*hash = ""
+		return false
+	}
+
+	h, err := s.Storage.etagHash(ctx, dir)
+	if err != nil {
+		log.Printf("poll %s: %v", dir, err)
+		return false
+	}
+
+	changed := h != *hash
+	*hash = h
+
+	return changed
+}
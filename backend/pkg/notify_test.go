@@ -0,0 +1,152 @@
+package dinghy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
+	"google.golang.org/grpc"
+)
+
+func Test_changedEntry(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		dir          string
+		wantEntry    string
+		wantAffected bool
+	}{
+		{"unknown change", "", "/a/", "", true},
+		{"file in directory", "files/a/x.txt", "/a/", "", true},
+		{"file in root", "files/x.txt", "/", "", true},
+		{"directory marker in directory", "files/a/b/", "/a/", "", true},
+		{"file in subdirectory", "files/a/b/c/x.txt", "/a/", "b", true},
+		{"file in sibling", "files/ab/x.txt", "/a/", "", false},
+		{"file in parent", "files/x.txt", "/a/", "", false},
+		{"thumbnail", "thumbnails/a/x.png", "/a/", "", false},
+		{"audit log", "audit/2024-01-01/x.jsonl", "/", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, affected := changedEntry(&pb.Event{Key: tt.key}, tt.dir)
+			if entry != tt.wantEntry || affected != tt.wantAffected {
+				t.Errorf("changedEntry() = %q, %v, want %q, %v", entry, affected, tt.wantEntry, tt.wantAffected)
+			}
+		})
+	}
+}
+
+func Test_wakes(t *testing.T) {
+	previous := &Directory{Path: "a/", Directories: []string{"b"}}
+
+	tests := []struct {
+		name      string
+		event     *pb.Event
+		previous  *Directory
+		want      bool
+		wantCheck string
+	}{
+		{"created in known subdirectory", &pb.Event{Key: "files/a/b/x.txt", Name: eventCreated}, previous, false, ""},
+		{"created in new subdirectory", &pb.Event{Key: "files/a/c/x.txt", Name: eventCreated}, previous, true, ""},
+		{"created without previous listing", &pb.Event{Key: "files/a/b/x.txt", Name: eventCreated}, nil, true, ""},
+		{"removed in listed subdirectory", &pb.Event{Key: "files/a/b/x.txt", Name: eventRemoved}, previous, true, "b"},
+		{"removed in unlisted subdirectory", &pb.Event{Key: "files/a/c/x.txt", Name: eventRemoved}, previous, false, ""},
+		{"removed in directory", &pb.Event{Key: "files/a/x.txt", Name: eventRemoved}, previous, true, ""},
+		{"changed elsewhere", &pb.Event{Key: "files/z/x.txt", Name: eventCreated}, previous, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, check := wakes(tt.event, "/a/", tt.previous)
+			if got != tt.want || check != tt.wantCheck {
+				t.Errorf("wakes() = %v, %q, want %v, %q", got, check, tt.want, tt.wantCheck)
+			}
+		})
+	}
+}
+
+func Test_relistThrottle(t *testing.T) {
+	throttle := &relistThrottle{interval: 50 * time.Millisecond}
+	defer throttle.stop()
+
+	if !throttle.wake("") {
+		t.Fatal("first change was not listed immediately")
+	}
+	throttle.listed()
+
+	for i := 0; i < 100; i++ {
+		if throttle.wake(fmt.Sprintf("dir%d", i%3)) {
+			t.Fatalf("change %d within the interval was listed immediately", i)
+		}
+	}
+
+	// the checks are only run once for the merged relist
+	if throttle.changed || len(throttle.checks) != 3 {
+		t.Errorf("merged checks = %v, changed %v", throttle.checks, throttle.changed)
+	}
+
+	select {
+	case <-throttle.C:
+	case <-time.After(time.Second):
+		t.Fatal("merged relist is not due")
+	}
+	throttle.listed()
+
+	if throttle.C != nil || throttle.checks != nil {
+		t.Errorf("relist still pending")
+	}
+}
+
+// countingNotifier counts the calls of Notify and fails them with err.
+type countingNotifier struct {
+	pb.NotifierClient
+	calls int
+	err   error
+}
+
+func (n *countingNotifier) Notify(ctx context.Context, in *pb.Request, opts ...grpc.CallOption) (*pb.Response, error) {
+	n.calls++
+	return &pb.Response{}, n.err
+}
+
+func TestNotifyAdapter_breaker(t *testing.T) {
+	client := &countingNotifier{err: errors.New("unavailable")}
+	n := &NotifyAdapter{NotifierClient: client}
+
+	for i := 0; i < breakerThreshold; i++ {
+		n.notify(context.Background(), &pb.Event{})
+	}
+
+	if n.Available() {
+		t.Fatalf("available after %d failures", breakerThreshold)
+	}
+
+	n.notify(context.Background(), &pb.Event{})
+	if client.calls != breakerThreshold {
+		t.Errorf("open breaker made call %d", client.calls)
+	}
+
+	// the cooldown passed and notify recovered
+	n.next = time.Now()
+	client.err = nil
+
+	n.notify(context.Background(), &pb.Event{})
+	if client.calls != breakerThreshold+1 || !n.Available() {
+		t.Errorf("calls = %d, available = %v after recovery", client.calls, n.Available())
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	for failures, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		d := backoff(failures)
+		if d < max/2 || d > max {
+			t.Errorf("backoff(%d) = %v, want between %v and %v", failures, d, max/2, max)
+		}
+	}
+
+	if d := backoff(100); d > retryMaxDelay {
+		t.Errorf("backoff(100) = %v exceeds %v", d, retryMaxDelay)
+	}
+}
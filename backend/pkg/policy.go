@@ -0,0 +1,215 @@
+package dinghy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+// Permission is an operation a user may execute below a path prefix.
+type Permission string
+
+const (
+	PermissionRead    Permission = "read"
+	PermissionWrite   Permission = "write"
+	PermissionDelete  Permission = "delete"
+	PermissionExtract Permission = "extract"
+)
+
+const (
+	anyUser         = "*"
+	userPlaceholder = "{user}"
+)
+
+// Policy grants users and groups permissions on path prefixes.
+// A nil policy allows everything.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+	// Home grants every user all permissions below Home + user name + "/".
+	Home string `json:"home,omitempty"`
+}
+
+// Rule grants permissions below Prefix to the listed users and groups.
+// The user "*" matches everybody, {user} in the prefix is replaced by the user name.
+type Rule struct {
+	Users       []string     `json:"users,omitempty"`
+	Groups      []string     `json:"groups,omitempty"`
+	Prefix      string       `json:"prefix"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// LoadPolicy reads a json policy file.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy %s: %v", path, err)
+	}
+
+	p, err := parsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse policy %s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+func parsePolicy(b []byte) (*Policy, error) {
+	p := &Policy{}
+
+	err := json.Unmarshal(b, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range p.Rules {
+		if !strings.HasPrefix(r.Prefix, "/") || !strings.HasSuffix(r.Prefix, "/") {
+			return nil, fmt.Errorf("rule %d: prefix %s needs to start and end with /", i, r.Prefix)
+		}
+
+		for _, perm := range r.Permissions {
+			switch perm {
+			case PermissionRead, PermissionWrite, PermissionDelete, PermissionExtract:
+			default:
+				return nil, fmt.Errorf("rule %d: unknown permission %s", i, perm)
+			}
+		}
+	}
+
+	if p.Home != "" {
+		if !strings.HasPrefix(p.Home, "/") || !strings.HasSuffix(p.Home, "/") {
+			return nil, fmt.Errorf("home %s needs to start and end with /", p.Home)
+		}
+
+		p.Rules = append(p.Rules, Rule{
+			Users:       []string{anyUser},
+			Prefix:      p.Home + userPlaceholder + "/",
+			Permissions: []Permission{PermissionRead, PermissionWrite, PermissionDelete, PermissionExtract},
+		})
+	}
+
+	return p, nil
+}
+
+// prefixes returns the path prefixes the user holds the permission for.
+func (p *Policy) prefixes(u auth.User, perm Permission) []string {
+	prefixes := []string{}
+
+	for _, r := range p.Rules {
+		if !r.grants(perm) || !r.matches(u) {
+			continue
+		}
+
+		prefix := r.Prefix
+		if strings.Contains(prefix, userPlaceholder) {
+			if u.Name == "" || strings.Contains(u.Name, "/") || u.Name == "." || u.Name == ".." {
+				continue
+			}
+			prefix = strings.ReplaceAll(prefix, userPlaceholder, u.Name)
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes
+}
+
+func (r Rule) grants(perm Permission) bool {
+	for _, p := range r.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r Rule) matches(u auth.User) bool {
+	for _, name := range r.Users {
+		if name == anyUser || (name == u.Name && u.Name != "") {
+			return true
+		}
+	}
+
+	for _, group := range r.Groups {
+		for _, g := range u.Groups {
+			if group == g {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowed reports if the user holds the permission for path.
+func (p *Policy) allowed(u auth.User, perm Permission, path string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, prefix := range p.prefixes(u, perm) {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// traversable reports if the user may list the directory,
+// either to read it or to reach a readable directory below it.
+func (p *Policy) traversable(u auth.User, dir string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, prefix := range p.prefixes(u, PermissionRead) {
+		if strings.HasPrefix(dir, prefix) || strings.HasPrefix(prefix, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filter removes the entries of the listing the user can not read.
+func (p *Policy) filter(u auth.User, l Directory) Directory {
+	if p == nil {
+		return l
+	}
+
+	dir := "/" + l.Path
+
+	filtered := Directory{
+		Path:        l.Path,
+		Directories: []string{},
+		Files:       []File{},
+	}
+
+	for _, d := range l.Directories {
+		if p.traversable(u, dir+d+"/") {
+			filtered.Directories = append(filtered.Directories, d)
+		}
+	}
+
+	for _, f := range l.Files {
+		if p.allowed(u, PermissionRead, f.Path) {
+			filtered.Files = append(filtered.Files, f)
+		}
+	}
+
+	return filtered
+}
+
+func userFromContext(ctx context.Context) auth.User {
+	u, _ := auth.UserFromContext(ctx)
+	return u
+}
+
+func (s *ServiceServer) allowed(ctx context.Context, perm Permission, path string) bool {
+	return s.Policy.allowed(userFromContext(ctx), perm, path)
+}
@@ -0,0 +1,106 @@
+package dinghy
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+const testPolicy = `{
+  "home": "/home/",
+  "rules": [
+    {"groups": ["admins"], "prefix": "/", "permissions": ["read", "write", "delete", "extract"]},
+    {"users": ["*"], "prefix": "/public/", "permissions": ["read"]},
+    {"users": ["alice"], "prefix": "/projects/apollo/", "permissions": ["read", "write"]}
+  ]
+}`
+
+func TestPolicy_allowed(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := auth.User{Name: "alice"}
+	admin := auth.User{Name: "root", Groups: []string{"admins"}}
+	anonymous := auth.User{}
+
+	tests := []struct {
+		name string
+		user auth.User
+		perm Permission
+		path string
+		want bool
+	}{
+		{"admin reads everything", admin, PermissionRead, "/secret/file.txt", true},
+		{"admin deletes everything", admin, PermissionDelete, "/", true},
+		{"everybody reads public", anonymous, PermissionRead, "/public/file.txt", true},
+		{"nobody writes public", alice, PermissionWrite, "/public/file.txt", false},
+		{"anonymous reads nothing else", anonymous, PermissionRead, "/secret/file.txt", false},
+		{"user writes project", alice, PermissionWrite, "/projects/apollo/plan.txt", true},
+		{"user deletes not in project", alice, PermissionDelete, "/projects/apollo/plan.txt", false},
+		{"user reads home", alice, PermissionRead, "/home/alice/notes.txt", true},
+		{"user extracts in home", alice, PermissionExtract, "/home/alice/a.zip", true},
+		{"user reads other home", alice, PermissionRead, "/home/bob/notes.txt", false},
+		{"home prefix is not a name prefix", alice, PermissionRead, "/home/alicebob/notes.txt", false},
+		{"anonymous has no home", anonymous, PermissionRead, "/home//notes.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.allowed(tt.user, tt.perm, tt.path); got != tt.want {
+				t.Errorf("Policy.allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_filter(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := auth.User{Name: "alice"}
+
+	root := Directory{
+		Path:        "",
+		Directories: []string{"home", "projects", "public", "secret"},
+		Files:       []File{{Name: "root.txt", Path: "/root.txt"}},
+	}
+
+	want := Directory{
+		Path:        "",
+		Directories: []string{"home", "projects", "public"},
+		Files:       []File{},
+	}
+
+	if got := p.filter(alice, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("Policy.filter() = %v, want %v", got, want)
+	}
+
+	home := Directory{
+		Path:        "home/",
+		Directories: []string{"alice", "bob"},
+		Files:       []File{},
+	}
+
+	want = Directory{
+		Path:        "home/",
+		Directories: []string{"alice"},
+		Files:       []File{},
+	}
+
+	if got := p.filter(alice, home); !reflect.DeepEqual(got, want) {
+		t.Errorf("Policy.filter() = %v, want %v", got, want)
+	}
+
+	if p.traversable(alice, "/secret/") {
+		t.Errorf("Policy.traversable() = true for /secret/")
+	}
+
+	var none *Policy
+	if got := none.filter(alice, root); !reflect.DeepEqual(got, root) {
+		t.Errorf("nil Policy.filter() = %v, want %v", got, root)
+	}
+}
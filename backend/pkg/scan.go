@@ -0,0 +1,261 @@
+package dinghy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// quarantineDirectory holds infected files, it is not reachable through the api.
+const quarantineDirectory = "quarantine"
+
+// metadata keys recording the result of the virus scan
+const (
+	scanStatusKey    = "scan-status"
+	scanSignatureKey = "scan-signature"
+)
+
+// scan status of files
+const (
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanUnscanned = "unscanned"
+)
+
+// scanParallel limits the concurrent requests to look up the scan status of a listing.
+const scanParallel = 8
+
+// scanCacheSize bounds the number of remembered scan verdicts.
+const scanCacheSize = 10000
+
+// scanCache remembers the scan status of files by path and etag,
+// so that listings only look up files which are new or were replaced.
+// A nil cache remembers nothing.
+type scanCache struct {
+	mu       sync.Mutex
+	verdicts map[string]string
+}
+
+func newScanCache() *scanCache {
+	return &scanCache{verdicts: map[string]string{}}
+}
+
+func (c *scanCache) get(filePath, etag string) (string, bool) {
+	if c == nil || etag == "" {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status, ok := c.verdicts[filePath+"\x00"+etag]
+
+	return status, ok
+}
+
+func (c *scanCache) put(filePath, etag, status string) {
+	if c == nil || etag == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.verdicts) >= scanCacheSize {
+		c.verdicts = map[string]string{}
+	}
+
+	c.verdicts[filePath+"\x00"+etag] = status
+}
+
+// scan checks a file before it is stored at filePath and returns the metadata recording the result.
+// Infected files are moved to quarantine and rejected.
+func (s *ServiceServer) scan(ctx context.Context, filePath string, f io.ReadSeeker, contentType string) (map[string]string, error) {
+	if s.Scanner == nil {
+		return nil, nil
+	}
+
+	result, err := s.Scanner.Scan(ctx, f)
+	if err != nil {
+		log.Printf("scan %s: %v", filePath, err)
+		return nil, uploadError{http.StatusServiceUnavailable, "virus scan is not available, try again later"}
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("seek file: %v", err)
+	}
+
+	if !result.Infected {
+		return map[string]string{scanStatusKey: ScanClean}, nil
+	}
+
+	err = s.quarantine(ctx, filePath, f, contentType, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, uploadError{http.StatusUnprocessableEntity, fmt.Sprintf("file is infected with %s and has been quarantined", result.Signature)}
+}
+
+func (s *ServiceServer) quarantine(ctx context.Context, filePath string, f io.ReadSeeker, contentType string, result ScanResult) error {
+	log.Printf("quarantine %s: infected with %s", filePath, result.Signature)
+
+	err := s.Storage.upload(ctx, quarantineDirectory+filePath, f, contentType, map[string]string{
+		scanStatusKey:    ScanInfected,
+		scanSignatureKey: result.Signature,
+	})
+	if err != nil {
+		return fmt.Errorf("quarantine %s: %v", filePath, err)
+	}
+
+	return nil
+}
+
+// scanTree checks the files below the local directory src before they are stored in the directory target.
+// Infected files are moved to quarantine and removed from src.
+func (s *ServiceServer) scanTree(ctx context.Context, src, target string) error {
+	if s.Scanner == nil {
+		return nil
+	}
+
+	return filepath.Walk(src,
+		func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(src, file)
+			if err != nil {
+				return err
+			}
+
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			result, err := s.Scanner.Scan(ctx, f)
+			if err != nil {
+				return fmt.Errorf("scan %s: %v", rel, err)
+			}
+
+			if !result.Infected {
+				return nil
+			}
+
+			_, err = f.Seek(0, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("seek %s: %v", rel, err)
+			}
+
+			err = s.quarantine(ctx, target+filepath.ToSlash(rel), f, mime.TypeByExtension(filepath.Ext(file)), result)
+			if err != nil {
+				return err
+			}
+
+			return os.Remove(file)
+		})
+}
+
+// scanStatus returns the scan status of the file at filePath.
+func (s *ServiceServer) scanStatus(ctx context.Context, filePath string) (string, error) {
+	metadata, err := s.Storage.metadata(ctx, filesDirectory+filePath)
+	if err != nil {
+		return "", err
+	}
+
+	status := metadata[scanStatusKey]
+	if status == "" {
+		return ScanUnscanned, nil
+	}
+
+	return status, nil
+}
+
+// downloadable reports if the file at filePath may be delivered,
+// only clean files are if unscanned files are blocked.
+func (s *ServiceServer) downloadable(ctx context.Context, filePath string) (bool, error) {
+	if !s.BlockUnscanned {
+		return true, nil
+	}
+
+	status, err := s.scanStatus(ctx, filePath)
+	if err != nil {
+		return false, err
+	}
+
+	return status == ScanClean, nil
+}
+
+// rejectUnscanned responds for files which may not be delivered and reports if it did.
+func (s *ServiceServer) rejectUnscanned(w http.ResponseWriter, r *http.Request, filePath string) bool {
+	ok, err := s.downloadable(r.Context(), filePath)
+	if err != nil {
+		log.Printf("GET %s: scan status: %v", filePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	if !ok {
+		http.Error(w, "file has not been scanned for viruses yet", http.StatusForbidden)
+		return true
+	}
+
+	return false
+}
+
+// listing lists the directory at path including the scan status of the files if scanning is enabled.
+func (s *ServiceServer) listing(ctx context.Context, path string) (Directory, error) {
+	l, err := s.Storage.list(ctx, path)
+	if err != nil {
+		return Directory{}, err
+	}
+
+	if s.Scanner == nil && !s.BlockUnscanned {
+		return l, nil
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, scanParallel)
+
+	for i := range l.Files {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(f *File) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			status, ok := s.scans.get(f.Path, f.ETag)
+			if ok {
+				f.ScanStatus = status
+				return
+			}
+
+			status, err := s.scanStatus(ctx, f.Path)
+			if err != nil {
+				log.Printf("scan status %s: %v", f.Path, err)
+				return
+			}
+
+			s.scans.put(f.Path, f.ETag, status)
+			f.ScanStatus = status
+		}(&l.Files[i])
+	}
+
+	wg.Wait()
+
+	return l, nil
+}
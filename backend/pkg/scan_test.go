@@ -0,0 +1,35 @@
+package dinghy
+
+import "testing"
+
+func Test_scanCache(t *testing.T) {
+	c := newScanCache()
+	c.put("/a.txt", "etag1", ScanClean)
+
+	tests := []struct {
+		name   string
+		path   string
+		etag   string
+		want   string
+		wantOK bool
+	}{
+		{"same file", "/a.txt", "etag1", ScanClean, true},
+		{"replaced file", "/a.txt", "etag2", "", false},
+		{"other file", "/b.txt", "etag1", "", false},
+		{"without etag", "/a.txt", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.get(tt.path, tt.etag)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("get() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+
+	var disabled *scanCache
+	disabled.put("/a.txt", "etag1", ScanClean)
+	if _, ok := disabled.get("/a.txt", "etag1"); ok {
+		t.Error("nil cache remembered a verdict")
+	}
+}
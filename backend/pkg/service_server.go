@@ -1,10 +1,15 @@
 package dinghy
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/middleware"
 )
 
 // ServiceServer executes the users requests.
@@ -13,20 +18,63 @@ type ServiceServer struct {
 	Notify      *NotifyAdapter
 	FrontendURL string
 	Upgrader    websocket.Upgrader
+	Policy      *Policy
+	Uploads     *UploadPolicy
+	Scanner     *Scanner
+	// BlockUnscanned refuses downloads of files not scanned clean.
+	BlockUnscanned bool
+	Shares         *Shares
+	Limiter        *auth.RateLimiter
+	Audit          *AuditLog
+	UserContent    *UserContent
+	// TrustProxy takes client ips from the X-Forwarded-For header.
+	TrustProxy bool
+	// RelistInterval is the minimal time between two listings sent for a watched directory.
+	RelistInterval time.Duration
+
+	scans *scanCache
 }
 
 // NewServiceServer creates a new service server and initiates the routes.
 func NewServiceServer() *ServiceServer {
-	srv := &ServiceServer{}
+	srv := &ServiceServer{scans: newScanCache()}
 	return srv
 }
 
 func (s *ServiceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.UserContent.handles(r) && strings.HasPrefix(r.URL.Path, sharePrefix) {
+		s.serveShares(w, r)
+		return
+	}
+
+	path, err := canonicalPath(r.URL.Path)
+	if err != nil {
+		log.Printf("%s %q: %v", r.Method, r.URL.Path, err)
+		http.Error(w, fmt.Sprintf("invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	r.URL.Path = path
+	r.URL.RawPath = ""
+
+	if s.UserContent.handles(r) {
+		s.serveUserContent(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		log.Printf("%s %s: forbidden for user %s", r.Method, r.URL.Path, userFromContext(r.Context()).Name)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodOptions:
 		return
 	case http.MethodGet:
 		s.get(w, r)
+	case http.MethodHead:
+		s.head(w, r)
 	case http.MethodPut:
 		s.put(w, r)
 	case http.MethodDelete:
@@ -36,3 +84,28 @@ func (s *ServiceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+func (s *ServiceServer) authorized(r *http.Request) bool {
+	u := userFromContext(r.Context())
+	path := r.URL.Path
+
+	switch r.Method {
+	case http.MethodGet:
+		if middleware.IsWebsocket(r) {
+			// websocket commands are authorized individually
+			return true
+		}
+		if strings.HasSuffix(path, "/") {
+			return s.Policy.traversable(u, path)
+		}
+		return s.Policy.allowed(u, PermissionRead, path)
+	case http.MethodHead:
+		return s.Policy.allowed(u, PermissionRead, path)
+	case http.MethodPut:
+		return s.Policy.allowed(u, PermissionWrite, path)
+	case http.MethodDelete:
+		return s.Policy.allowed(u, PermissionDelete, path)
+	}
+
+	return true
+}
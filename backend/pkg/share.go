@@ -0,0 +1,575 @@
+package dinghy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sharePrefix     = "/" + reservedSegment + "/s/"
+	sharesDirectory = "shares/"
+	defaultShareTTL = 7 * 24 * time.Hour
+	// countRetries limits the attempts to count a download against concurrent downloads.
+	countRetries = 10
+)
+
+// errShareUsed tells that all downloads of a share were made.
+var errShareUsed = errors.New("download limit of share reached")
+
+// Shares mints and verifies signed share tokens.
+// The state of a share is stored as json object in the bucket.
+type Shares struct {
+	Key    []byte
+	MaxTTL time.Duration
+
+	// cache holds the shares by key and etag, so that listings only load changed shares.
+	mu    sync.Mutex
+	cache map[string]cachedShare
+}
+
+type cachedShare struct {
+	etag  string
+	share Share
+}
+
+// Share grants anonymous access to a file or directory.
+type Share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Owner        string    `json:"owner,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	PasswordHash string    `json:"passwordHash,omitempty"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+type shareRequest struct {
+	Path         string `json:"path"`
+	ExpiresIn    string `json:"expiresIn"`
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"maxDownloads"`
+}
+
+type shareResponse struct {
+	Token        string    `json:"token"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Expires      time.Time `json:"expires"`
+	Protected    bool      `json:"protected"`
+	MaxDownloads int       `json:"maxDownloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+}
+
+// IsShareAccess reports if the request accesses shared content.
+// Shares are accessible without authentication.
+func IsShareAccess(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	return strings.HasPrefix(r.URL.Path, sharePrefix) && len(r.URL.Path) > len(sharePrefix)
+}
+
+func (sh *Shares) token(id string) string {
+	mac := hmac.New(sha256.New, sh.Key)
+	mac.Write([]byte(id))
+
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (sh *Shares) verify(token string) (string, bool) {
+	id, _, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+
+	return id, subtle.ConstantTimeCompare([]byte(token), []byte(sh.token(id))) == 1
+}
+
+func (s *ServiceServer) serveShares(w http.ResponseWriter, r *http.Request) {
+	if s.Shares == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, sharePrefix), "/")
+
+	rest, err := canonicalPath("/" + rest)
+	if err != nil {
+		log.Printf("%s %q: %v", r.Method, r.URL.Path, err)
+		http.Error(w, fmt.Sprintf("invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+	rest = rest[1:]
+
+	switch {
+	case r.Method == http.MethodOptions:
+		return
+	case token == "" && r.Method == http.MethodPost:
+		s.createShare(w, r)
+	case token == "" && r.Method == http.MethodGet:
+		s.listShares(w, r)
+	case token != "" && r.Method == http.MethodDelete:
+		s.revokeShare(w, r, token)
+	case token != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		s.accessShare(w, r, token, rest)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ServiceServer) createShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req := shareRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parse request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req.Path, err = canonicalPath(req.Path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid path: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowed(ctx, PermissionRead, req.Path) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultShareTTL
+	if req.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "invalid expiresIn", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.Shares.MaxTTL > 0 && ttl > s.Shares.MaxTTL {
+		ttl = s.Shares.MaxTTL
+	}
+
+	if !strings.HasSuffix(req.Path, "/") {
+		found, _, _, err := s.Storage.exists(ctx, filesDirectory+req.Path)
+		if err != nil {
+			log.Printf("create share %s: %v", req.Path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	share := Share{
+		ID:           randomID(),
+		Path:         req.Path,
+		Owner:        userFromContext(ctx).Name,
+		Created:      now,
+		Expires:      now.Add(ttl),
+		MaxDownloads: req.MaxDownloads,
+	}
+
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("create share %s: hash password: %v", req.Path, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		share.PasswordHash = string(hash)
+	}
+
+	err = s.saveShare(ctx, share)
+	s.audit(r, AuditShareCreate, req.Path, 0, auditResult(err), err)
+	if err != nil {
+		log.Printf("create share %s: %v", req.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(s.shareResponse(share))
+	if err != nil {
+		log.Printf("create share %s: respond: %v", req.Path, err)
+	}
+}
+
+func (s *ServiceServer) shareResponse(share Share) shareResponse {
+	token := s.Shares.token(share.ID)
+
+	return shareResponse{
+		Token:        token,
+		URL:          sharePrefix + token,
+		Path:         share.Path,
+		Expires:      share.Expires,
+		Protected:    share.PasswordHash != "",
+		MaxDownloads: share.MaxDownloads,
+		Downloads:    share.Downloads,
+	}
+}
+
+func (s *ServiceServer) listShares(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := userFromContext(ctx).Name
+
+	etags, err := s.Storage.listETags(ctx, sharesDirectory)
+	if err != nil {
+		log.Printf("list shares: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.Shares.forget(etags)
+
+	active := []shareResponse{}
+
+	for key, etag := range etags {
+		share, err := s.listedShare(ctx, key, etag)
+		if err != nil {
+			log.Printf("list shares: %v", err)
+			continue
+		}
+
+		if share.Owner != owner {
+			continue
+		}
+
+		if share.expired() {
+			s.deleteShare(ctx, share.ID)
+			continue
+		}
+
+		active = append(active, s.shareResponse(share))
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Expires.Before(active[j].Expires)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(active)
+	if err != nil {
+		log.Printf("list shares: respond: %v", err)
+	}
+}
+
+func (s *ServiceServer) revokeShare(w http.ResponseWriter, r *http.Request, token string) {
+	ctx := r.Context()
+
+	id, valid := s.Shares.verify(token)
+	if !valid {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	share, err := s.loadShare(ctx, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if share.Owner != userFromContext(ctx).Name {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.deleteShare(ctx, id)
+	s.audit(r, AuditShareRevoke, share.Path, 0, AuditOK, nil)
+}
+
+func (s *ServiceServer) accessShare(w http.ResponseWriter, r *http.Request, token, rest string) {
+	ctx := r.Context()
+
+	id, valid := s.Shares.verify(token)
+	if !valid {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	share, err := s.loadShare(ctx, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if share.expired() {
+		s.deleteShare(ctx, id)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if !share.unlocks(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="shared content", charset="UTF-8"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	target := share.Path
+	isDir := strings.HasSuffix(share.Path, "/")
+
+	if isDir {
+		// the rest of the request path is canonical already
+		target += rest
+	} else if rest != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if strings.HasSuffix(target, "/") {
+		l, err := s.listing(ctx, target)
+		if err != nil {
+			log.Printf("GET shared %s: %v", target, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err = respond(w, r, share.listing(l, token), "")
+		if err != nil {
+			log.Printf("GET shared %s: %v", target, err)
+		}
+		return
+	}
+
+	found, etag, contentType, err := s.Storage.exists(ctx, filesDirectory+target)
+	if err != nil {
+		log.Printf("GET shared %s: %v", target, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if s.rejectUnscanned(w, r, target) {
+		return
+	}
+
+	_, thumbnail, _ := parseRequest(r.URL.RawQuery)
+
+	switch {
+	case thumbnail && share.MaxDownloads > 0:
+		// thumbnails would show the content of limited shares without counting
+		w.WriteHeader(http.StatusForbidden)
+		return
+	case !thumbnail:
+		err = s.reserveDownload(ctx, id)
+		if err != nil && share.MaxDownloads > 0 {
+			log.Printf("GET shared %s: %v", target, err)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Printf("GET shared %s: %v", target, err)
+		}
+	}
+
+	err = s.download(ctx, target, etag, contentType, false, w, r)
+	if err != nil {
+		log.Printf("GET shared %s: %v", target, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// reserveDownload counts a download before it is delivered and burns the share with the last allowed one.
+// The count is written on condition that the share is unchanged since it was read,
+// concurrent downloads read the share again and retry.
+func (s *ServiceServer) reserveDownload(ctx context.Context, id string) error {
+	for i := 0; i < countRetries; i++ {
+		share, etag, err := s.loadShareETag(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+			s.deleteShare(ctx, id)
+			return errShareUsed
+		}
+
+		share.Downloads++
+
+		b, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+
+		err = s.Storage.putObjectIfMatch(ctx, shareKey(id), b, "application/json", etag)
+		if err == errModified {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("reserve download of share %s: %v", id, err)
+		}
+
+		if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+			s.deleteShare(ctx, id)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("reserve download of share %s: %v", id, errModified)
+}
+
+func (sh Share) expired() bool {
+	return time.Now().After(sh.Expires)
+}
+
+func (sh Share) unlocks(r *http.Request) bool {
+	if sh.PasswordHash == "" {
+		return true
+	}
+
+	password := r.Header.Get("X-Share-Password")
+	if password == "" {
+		_, password, _ = r.BasicAuth()
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(sh.PasswordHash), []byte(password)) == nil
+}
+
+// listing rewrites the paths of a shared directory listing to the share url.
+func (sh Share) listing(l Directory, token string) Directory {
+	base := sharePrefix + token + "/"
+	rel := strings.TrimPrefix("/"+l.Path, sh.Path)
+
+	shared := Directory{
+		Path:        strings.TrimPrefix(base, "/") + rel,
+		Directories: l.Directories,
+		Files:       make([]File, 0, len(l.Files)),
+	}
+
+	for _, f := range l.Files {
+		f.Path = base + rel + f.Name
+		f.DownloadURL = fileURL(f.Path)
+		if f.Thumbnail != "" && sh.MaxDownloads == 0 {
+			f.Thumbnail = fileURL(f.Path, "thumbnail")
+		} else {
+			// thumbnails of limited shares are not served
+			f.Thumbnail = ""
+		}
+		shared.Files = append(shared.Files, f)
+	}
+
+	return shared
+}
+
+func shareKey(id string) string {
+	return sharesDirectory + id + ".json"
+}
+
+func (s *ServiceServer) loadShare(ctx context.Context, id string) (Share, error) {
+	share, _, err := s.loadShareETag(ctx, id)
+	return share, err
+}
+
+func (s *ServiceServer) loadShareETag(ctx context.Context, id string) (Share, string, error) {
+	b, etag, err := s.Storage.getObjectETag(ctx, shareKey(id))
+	if err != nil {
+		return Share{}, "", fmt.Errorf("load share %s: %v", id, err)
+	}
+
+	share := Share{}
+
+	err = json.Unmarshal(b, &share)
+	if err != nil {
+		return Share{}, "", fmt.Errorf("parse share %s: %v", id, err)
+	}
+
+	return share, etag, nil
+}
+
+// listedShare returns the share stored at key, it is only loaded if its etag changed since the last listing.
+func (s *ServiceServer) listedShare(ctx context.Context, key, etag string) (Share, error) {
+	sh := s.Shares
+
+	sh.mu.Lock()
+	c, ok := sh.cache[key]
+	sh.mu.Unlock()
+
+	if ok && c.etag == etag {
+		return c.share, nil
+	}
+
+	share, etag, err := s.loadShareETag(ctx, strings.TrimSuffix(strings.TrimPrefix(key, sharesDirectory), ".json"))
+	if err != nil {
+		return Share{}, err
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.cache == nil {
+		sh.cache = map[string]cachedShare{}
+	}
+	sh.cache[key] = cachedShare{etag: etag, share: share}
+
+	return share, nil
+}
+
+// forget drops the cached shares missing in the listed etags.
+func (sh *Shares) forget(etags map[string]string) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for key := range sh.cache {
+		if _, ok := etags[key]; !ok {
+			delete(sh.cache, key)
+		}
+	}
+}
+
+func (s *ServiceServer) saveShare(ctx context.Context, share Share) error {
+	b, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+
+	return s.Storage.putObject(ctx, shareKey(share.ID), b, "application/json")
+}
+
+func (s *ServiceServer) deleteShare(ctx context.Context, id string) {
+	err := s.Storage.delete(ctx, shareKey(id))
+	if err != nil {
+		log.Printf("delete share %s: %v", id, err)
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
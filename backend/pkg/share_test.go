@@ -0,0 +1,319 @@
+package dinghy
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestShares_verify(t *testing.T) {
+	sh := &Shares{Key: []byte("0123456789abcdef0123456789abcdef")}
+	token := sh.token("abc")
+
+	tests := []struct {
+		name   string
+		token  string
+		wantID string
+		want   bool
+	}{
+		{"valid", token, "abc", true},
+		{"other id", "abd" + token[3:], "abd", false},
+		{"no signature", "abc", "", false},
+		{"empty signature", "abc.", "abc", false},
+		{"foreign key", (&Shares{Key: []byte("another key")}).token("abc"), "abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, got := sh.verify(tt.token)
+			if got != tt.want || id != tt.wantID {
+				t.Errorf("Shares.verify() = %v, %v, want %v, %v", id, got, tt.wantID, tt.want)
+			}
+		})
+	}
+}
+
+func TestShare_listing(t *testing.T) {
+	share := Share{Path: "/photos/"}
+
+	l := Directory{
+		Path:        "photos/2020/",
+		Directories: []string{"summer"},
+		Files: []File{
+			{Name: "a.jpg", Path: "/photos/2020/a.jpg", DownloadURL: "photos/2020/a.jpg?redirect", Thumbnail: "photos/2020/a.jpg?redirect&thumbnail"},
+		},
+	}
+
+	want := Directory{
+		Path:        ".dinghy/s/token/2020/",
+		Directories: []string{"summer"},
+		Files: []File{
+			{Name: "a.jpg", Path: "/.dinghy/s/token/2020/a.jpg", DownloadURL: ".dinghy/s/token/2020/a.jpg", Thumbnail: ".dinghy/s/token/2020/a.jpg?thumbnail"},
+		},
+	}
+
+	if got := share.listing(l, "token"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Share.listing() = %v, want %v", got, want)
+	}
+
+	// limited shares do not serve thumbnails
+	share.MaxDownloads = 1
+	want.Files[0].Thumbnail = ""
+
+	if got := share.listing(l, "token"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Share.listing() of limited share = %v, want %v", got, want)
+	}
+}
+
+// fakeS3 stores objects in memory with types by extension, honors If-Match on puts and lists objects below a prefix.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	lists   int
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Contents       []listedObject
+	CommonPrefixes []commonPrefix
+}
+
+type listedObject struct {
+	Key  string
+	Size int
+	ETag string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+// list answers ListObjectsV2 requests for the objects of bucket.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	f.lists++
+
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+
+	result := listBucketResult{}
+	prefixes := map[string]bool{}
+	for key, b := range f.objects {
+		key = strings.TrimPrefix(key, "/"+bucket+"/")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			p := key[:len(prefix)+i+len(delimiter)]
+			if !prefixes[p] {
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+			}
+			prefixes[p] = true
+			continue
+		}
+
+		result.Contents = append(result.Contents, listedObject{Key: key, Size: len(b), ETag: fmt.Sprintf("%x", md5.Sum(b))})
+	}
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	etag := func(b []byte) string {
+		return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(b)))
+	}
+
+	if bucket := strings.Trim(r.URL.Path, "/"); r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, r, bucket)
+		return
+	}
+
+	b, found := f.objects[r.URL.Path]
+
+	switch r.Method {
+	case http.MethodGet:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(b))
+		_, _ = w.Write(b)
+	case http.MethodHead:
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", etag(b))
+		w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(r.URL.Path)))
+	case http.MethodPut:
+		if m := r.Header.Get("If-Match"); m != "" && (!found || m != etag(b)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// fakeStorage serves the bucket "bucket" from fake.
+func fakeStorage(t *testing.T, fake *fakeS3) *MinioAdapter {
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(srv.URL),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials("key", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &MinioAdapter{Client: s3.New(sess), Bucket: "bucket"}
+}
+
+func TestServiceServer_accessShare_downloads(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDownloads int
+		requests     int
+		thumbnail    bool
+		wantOK       int
+		want         int
+		wantDeleted  bool
+	}{
+		{name: "concurrent downloads", requests: 8, wantOK: 8, want: 8},
+		{name: "limit reached", maxDownloads: 3, requests: 8, wantOK: 3, wantDeleted: true},
+		{name: "thumbnail of limited share", maxDownloads: 3, requests: 1, thumbnail: true, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServiceServer()
+			s.Storage = fakeStorage(t, &fakeS3{objects: map[string][]byte{"/bucket/files/a.txt": []byte("a")}})
+			s.Shares = &Shares{Key: []byte("0123456789abcdef0123456789abcdef")}
+
+			err := s.saveShare(context.Background(), Share{ID: "abc", Path: "/a.txt", Expires: time.Now().Add(time.Hour), MaxDownloads: tt.maxDownloads})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := sharePrefix + s.Shares.token("abc")
+			if tt.thumbnail {
+				target += "?thumbnail"
+			}
+
+			mu := sync.Mutex{}
+			ok := 0
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < tt.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					w := httptest.NewRecorder()
+					s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+					if w.Code == http.StatusOK {
+						mu.Lock()
+						ok++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+
+			if ok != tt.wantOK {
+				t.Errorf("%d of %d downloads delivered, want %d", ok, tt.requests, tt.wantOK)
+			}
+
+			share, err := s.loadShare(context.Background(), "abc")
+			if tt.wantDeleted {
+				if err == nil {
+					t.Errorf("share exists with %d downloads", share.Downloads)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if share.Downloads != tt.want {
+				t.Errorf("downloads = %d, want %d", share.Downloads, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceServer_accessShare_scriptable(t *testing.T) {
+	u, _ := url.Parse("https://usercontent.example.com")
+
+	s := NewServiceServer()
+	s.Storage = fakeStorage(t, &fakeS3{objects: map[string][]byte{"/bucket/files/site/index.html": []byte("<h1>site</h1>")}})
+	s.Shares = &Shares{Key: []byte("0123456789abcdef0123456789abcdef")}
+	s.UserContent = &UserContent{URL: u, Key: []byte("0123456789abcdef0123456789abcdef"), TTL: time.Hour}
+
+	err := s.saveShare(context.Background(), Share{ID: "abc", Path: "/site/index.html", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, sharePrefix+s.Shares.token("abc"), nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("code = %v, want %v", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != "attachment; filename=index.html" {
+		t.Errorf("disposition = %v", got)
+	}
+}
+
+func TestServiceServer_ServeHTTP_shareRoute(t *testing.T) {
+	s := NewServiceServer()
+	s.Storage = fakeStorage(t, &fakeS3{objects: map[string][]byte{"/bucket/files/s/a.txt": []byte("a")}})
+	s.Shares = &Shares{Key: []byte("0123456789abcdef0123456789abcdef")}
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"file in directory s", "/s/a.txt", http.StatusOK},
+		{"share outside its directory", sharePrefix + s.Shares.token("abc") + "/../a.txt", http.StatusBadRequest},
+		{"file in reserved directory", "/.dinghy/a.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package dinghy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
+)
+
+// heartbeatInterval keeps idle event streams open through proxies.
+const heartbeatInterval = 15 * time.Second
+
+// change is the data of a change event.
+type change struct {
+	Name string
+	Path string
+	Size int64  `json:"Size,omitempty"`
+	ETag string `json:"ETag,omitempty"`
+}
+
+// serveEvents streams server-sent events for a directory.
+// By default the listing is sent whenever it changes, with ?changes the individual changes are sent.
+// Reconnecting clients pass the id of the last received event in Last-Event-ID,
+// listings are only sent again if they differ and missed changes are replayed.
+func (s *ServiceServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Path
+	if !strings.HasSuffix(dir, "/") {
+		http.Error(w, "events are only available for directories", http.StatusBadRequest)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+
+	// the stream outlives the write timeout of the server
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		log.Printf("EVENTS %s: clear write deadline: %v", dir, err)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, rc: rc}
+
+	_, changes := r.URL.Query()["changes"]
+	if changes {
+		err = s.streamChanges(r.Context(), stream, dir, r.Header.Get("Last-Event-ID"))
+	} else {
+		err = s.streamListings(r.Context(), stream, dir, r.Header.Get("Last-Event-ID"))
+	}
+
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("EVENTS %s: %v", dir, err)
+	}
+}
+
+// streamListings sends the listing of dir whenever it changes.
+// The id of a listing is the hash of its content.
+func (s *ServiceServer) streamListings(ctx context.Context, stream *eventStream, dir, lastID string) error {
+	notify := s.Notify.listen(ctx)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	throttle := &relistThrottle{interval: s.RelistInterval}
+	defer throttle.stop()
+
+	poll := time.NewTicker(s.Notify.pollInterval())
+	defer poll.Stop()
+
+	pollHash := ""
+	var previous *Directory
+
+	send := func() error {
+		listing, err := s.listing(ctx, dir)
+		if err != nil {
+			return fmt.Errorf("list %s: %v", dir, err)
+		}
+
+		listing = s.Policy.filter(userFromContext(ctx), listing)
+		previous = &listing
+		throttle.listed()
+
+		b, err := json.Marshal(listing)
+		if err != nil {
+			return fmt.Errorf("encode listing: %v", err)
+		}
+
+		sum := sha256.Sum256(b)
+		id := hex.EncodeToString(sum[:16])
+		if id == lastID {
+			return nil
+		}
+		lastID = id
+
+		return stream.event("listing", id, b)
+	}
+
+	err := send()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			err = stream.heartbeat()
+		case e := <-notify:
+			wake, check := wakes(e, dir, previous)
+			if wake && throttle.wake(check) && s.relistNeeded(ctx, dir, throttle) {
+				err = send()
+			}
+		case <-throttle.C:
+			if s.relistNeeded(ctx, dir, throttle) {
+				err = send()
+			}
+		case <-poll.C:
+			if s.polledChange(ctx, dir, &pollHash) {
+				err = send()
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// streamChanges sends the changes below dir.
+// The id of a change is made of the stream and the sequence number assigned by notify,
+// a gap event tells that changes were lost and the directory needs to be listed again.
+func (s *ServiceServer) streamChanges(ctx context.Context, stream *eventStream, dir, lastID string) error {
+	u := userFromContext(ctx)
+
+	events := s.Notify.listenAfter(ctx, parseChangeID(lastID))
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			err = stream.heartbeat()
+		case e := <-events:
+			id := changeID(e)
+
+			if e.Gap || e.Key == "" {
+				err = stream.event("gap", id, []byte("{}"))
+				break
+			}
+
+			_, affected := changedEntry(e, dir)
+			p := strings.TrimPrefix(e.Key, filesDirectory)
+			if !affected || !s.changeVisible(u, p) {
+				continue
+			}
+
+			b, merr := json.Marshal(change{Name: e.Name, Path: p, Size: e.Size, ETag: e.Etag})
+			if merr != nil {
+				return fmt.Errorf("encode change: %v", merr)
+			}
+
+			err = stream.event("change", id, b)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// changeVisible tells whether the user may see a change of the file or directory marker at p.
+// Directories are shown to users allowed below them, files only to their readers.
+func (s *ServiceServer) changeVisible(u auth.User, p string) bool {
+	if strings.HasSuffix(p, "/") {
+		return s.Policy.traversable(u, p)
+	}
+
+	return s.Policy.allowed(u, PermissionRead, p)
+}
+
+func changeID(e *pb.Event) string {
+	if e.Stream == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s.%d", e.Stream, e.Sequence)
+}
+
+// parseChangeID returns the position to resume from, an empty event for invalid ids.
+func parseChangeID(id string) *pb.Event {
+	stream, seq, found := strings.Cut(id, ".")
+	if !found {
+		return &pb.Event{}
+	}
+
+	sequence, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return &pb.Event{}
+	}
+
+	return &pb.Event{Stream: stream, Sequence: sequence}
+}
+
+// eventStream writes server-sent events.
+type eventStream struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (s *eventStream) event(name, id string, data []byte) error {
+	_, err := fmt.Fprintf(s.w, "event: %s\nid: %s\ndata: %s\n\n", name, id, data)
+	if err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+func (s *eventStream) heartbeat() error {
+	_, err := io.WriteString(s.w, ": heartbeat\n\n")
+	if err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
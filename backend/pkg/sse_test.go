@@ -0,0 +1,309 @@
+package dinghy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeNotifier streams fixed events to subscribers resuming at the expected position.
+type fakeNotifier struct {
+	pb.UnimplementedNotifierServer
+	want   *pb.SubscribeRequest
+	events []*pb.Event
+}
+
+func (n *fakeNotifier) Subscribe(in *pb.SubscribeRequest, stream pb.Notifier_SubscribeServer) error {
+	events := n.events
+	if in.After != n.want.After || in.Stream != n.want.Stream {
+		events = []*pb.Event{{Stream: "s", Sequence: 9, Gap: true}}
+	}
+
+	for _, e := range events {
+		err := stream.Send(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	<-stream.Context().Done()
+
+	return nil
+}
+
+func notifyAdapter(t *testing.T, srv pb.NotifierServer) *NotifyAdapter {
+	l := bufconn.Listen(1 << 20)
+
+	s := grpc.NewServer()
+	pb.RegisterNotifierServer(s, srv)
+	go func() {
+		_ = s.Serve(l)
+	}()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &NotifyAdapter{NotifierClient: pb.NewNotifierClient(conn)}
+}
+
+func TestServiceServer_serveEvents_changes(t *testing.T) {
+	notifier := &fakeNotifier{
+		want: &pb.SubscribeRequest{After: 5, Stream: "s"},
+		events: []*pb.Event{
+			{Stream: "s", Sequence: 6, Key: "files/docs/a.txt", Name: eventCreated, Size: 3},
+			{Stream: "s", Sequence: 7, Key: "files/other/b.txt", Name: eventCreated},
+			{Stream: "s", Sequence: 8, Key: "files/docs/sub/c.txt", Name: eventRemoved},
+		},
+	}
+
+	s := &ServiceServer{Notify: notifyAdapter(t, notifier)}
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{
+			name:        "resume",
+			lastEventID: "s.5",
+			want: []string{
+				"event: change",
+				"id: s.6",
+				`data: {"Name":"s3:ObjectCreated:Put","Path":"/docs/a.txt","Size":3}`,
+				"",
+				"event: change",
+				"id: s.8",
+				`data: {"Name":"s3:ObjectRemoved:Delete","Path":"/docs/sub/c.txt"}`,
+				"",
+			},
+		},
+		{
+			name:        "position not available",
+			lastEventID: "s.1",
+			want: []string{
+				"event: gap",
+				"id: s.9",
+				"data: {}",
+				"",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/docs/?changes", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Set("Accept", "text/event-stream")
+			r.Header.Set("Last-Event-ID", tt.lastEventID)
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("Content-Type = %s", resp.Header.Get("Content-Type"))
+			}
+
+			scanner := bufio.NewScanner(resp.Body)
+			got := []string{}
+			for len(got) < len(tt.want) && scanner.Scan() {
+				got = append(got, scanner.Text())
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("events =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestServiceServer_serveEvents_changesPolicy(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notifier := &fakeNotifier{
+		want: &pb.SubscribeRequest{},
+		events: []*pb.Event{
+			{Stream: "s", Sequence: 1, Key: "files/projects/a", Name: eventCreated},
+			{Stream: "s", Sequence: 2, Key: "files/projects/gemini/", Name: eventCreated},
+			{Stream: "s", Sequence: 3, Key: "files/projects/apollo/plan.txt", Name: eventCreated},
+			{Stream: "s", Sequence: 4, Key: "files/projects/apollo/new/", Name: eventCreated},
+		},
+	}
+
+	s := &ServiceServer{Notify: notifyAdapter(t, notifier), Policy: policy}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeHTTP(w, r.WithContext(auth.WithUser(r.Context(), auth.User{Name: "alice"})))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/projects/?changes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	want := []string{
+		"event: change",
+		"id: s.3",
+		`data: {"Name":"s3:ObjectCreated:Put","Path":"/projects/apollo/plan.txt"}`,
+		"",
+		"event: change",
+		"id: s.4",
+		`data: {"Name":"s3:ObjectCreated:Put","Path":"/projects/apollo/new/"}`,
+		"",
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	got := []string{}
+	for len(got) < len(want) && scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// chanNotifier streams the events sent to its channel.
+type chanNotifier struct {
+	pb.UnimplementedNotifierServer
+	events chan *pb.Event
+}
+
+func (n *chanNotifier) Subscribe(in *pb.SubscribeRequest, stream pb.Notifier_SubscribeServer) error {
+	for {
+		select {
+		case e := <-n.events:
+			err := stream.Send(e)
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func TestServiceServer_serveEvents_listing(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{"/bucket/files/docs/a.txt": []byte("a")}}
+	storage := fakeStorage(t, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// listen starts a stream of listings of /docs/ resuming after lastEventID.
+	listen := func(notifier pb.NotifierServer, lastEventID string) <-chan []string {
+		s := NewServiceServer()
+		s.Storage = storage
+		s.Notify = notifyAdapter(t, notifier)
+
+		srv := httptest.NewServer(s)
+		t.Cleanup(srv.Close)
+
+		event := make(chan []string, 1)
+		go func() {
+			defer close(event)
+
+			r, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/docs/", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			r.Header.Set("Accept", "text/event-stream")
+			r.Header.Set("Last-Event-ID", lastEventID)
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+
+			scanner := bufio.NewScanner(resp.Body)
+			lines := []string{}
+			for len(lines) < 4 && scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			event <- lines
+		}()
+
+		return event
+	}
+
+	first := <-listen(&chanNotifier{}, "")
+	if len(first) != 4 || first[0] != "event: listing" || !strings.Contains(first[2], `"a.txt"`) {
+		t.Fatalf("first event = %q", first)
+	}
+	id := strings.TrimPrefix(first[1], "id: ")
+
+	fake.mu.Lock()
+	listed := fake.lists
+	fake.mu.Unlock()
+
+	notifier := &chanNotifier{events: make(chan *pb.Event, 1)}
+	resumed := listen(notifier, id)
+
+	// change the directory once the resumed stream listed it,
+	// the unchanged listing is not sent again and the next event is the changed listing
+	for changed := false; !changed; {
+		time.Sleep(10 * time.Millisecond)
+
+		fake.mu.Lock()
+		changed = fake.lists > listed
+		if changed {
+			fake.objects["/bucket/files/docs/b.txt"] = []byte("b")
+		}
+		fake.mu.Unlock()
+
+		if ctx.Err() != nil {
+			t.Fatal("resumed stream did not list")
+		}
+	}
+	notifier.events <- &pb.Event{Stream: "s", Sequence: 1, Key: "files/docs/b.txt", Name: eventCreated}
+
+	next := <-resumed
+	if len(next) != 4 || next[0] != "event: listing" || next[1] == first[1] || !strings.Contains(next[2], `"b.txt"`) {
+		t.Errorf("next event = %q", next)
+	}
+}
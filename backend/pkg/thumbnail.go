@@ -83,7 +83,7 @@ func (s *ServiceServer) prepareThumbnail(ctx context.Context, etag, path string)
 		return "", fmt.Errorf("seek thumbnail temp file: %v", err)
 	}
 
-	err = s.Storage.upload(ctx, thumbnailPath, tmpfile, contentType)
+	err = s.Storage.upload(ctx, thumbnailPath, tmpfile, contentType, nil)
 	if err != nil {
 		return "", fmt.Errorf("upload thumbnail: %v", err)
 	}
@@ -19,9 +19,9 @@ func (s ServiceServer) unzip(ctx context.Context, path string) error {
 		return err
 	}
 
-	target := filesDirectory + strings.TrimSuffix(path, ext)
+	target, _ := extractTarget(path)
 
-	exists, _, _, err := s.Storage.exists(ctx, target)
+	exists, _, _, err := s.Storage.exists(ctx, filesDirectory+strings.TrimSuffix(target, "/"))
 	if err != nil {
 		return fmt.Errorf("verify target location %s: %v", target, err)
 	}
@@ -57,8 +57,23 @@ func (s ServiceServer) unzip(ctx context.Context, path string) error {
 		}
 	}
 
+	err = s.Uploads.checkTree(tmpDir, target)
+	if err != nil {
+		return fmt.Errorf("verify content: %v", err)
+	}
+
+	err = s.scanTree(ctx, tmpDir, target)
+	if err != nil {
+		return fmt.Errorf("scan content: %v", err)
+	}
+
+	metadata := map[string]string(nil)
+	if s.Scanner != nil {
+		metadata = map[string]string{scanStatusKey: ScanClean}
+	}
+
 	defer span.Finish()
-	err = s.Storage.uploadRecursive(ctx, tmpDir, target)
+	err = s.Storage.uploadRecursive(ctx, tmpDir, target, metadata)
 	if err != nil {
 		return fmt.Errorf("upload: %v", err)
 	}
@@ -66,6 +81,26 @@ func (s ServiceServer) unzip(ctx context.Context, path string) error {
 	return nil
 }
 
+// mayExtract checks the permission to extract the archive and to write its content.
+func (s *ServiceServer) mayExtract(ctx context.Context, path string) bool {
+	target, err := extractTarget(path)
+	if err != nil {
+		return false
+	}
+
+	return s.allowed(ctx, PermissionExtract, path) && s.allowed(ctx, PermissionWrite, target)
+}
+
+// extractTarget returns the directory the archive is extracted to.
+func extractTarget(path string) (string, error) {
+	ext, err := archiveExtension(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(path, ext) + "/", nil
+}
+
 func canBeExtracted(file string, dirs []string) bool {
 	ext, err := archiveExtension(file)
 	if err != nil {
@@ -0,0 +1,279 @@
+package dinghy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UploadPolicy limits size, media type and name of files stored below path prefixes.
+// A nil upload policy allows everything.
+type UploadPolicy struct {
+	Rules []UploadRule `json:"rules"`
+}
+
+// UploadRule restricts the files stored below Prefix,
+// the rule with the longest matching prefix applies.
+// Types are media types like image/png or image/*, names are shell patterns like *.exe.
+type UploadRule struct {
+	Prefix     string   `json:"prefix"`
+	MaxSize    int64    `json:"maxSize,omitempty"`
+	AllowTypes []string `json:"allowTypes,omitempty"`
+	DenyTypes  []string `json:"denyTypes,omitempty"`
+	AllowNames []string `json:"allowNames,omitempty"`
+	DenyNames  []string `json:"denyNames,omitempty"`
+}
+
+// uploadError is a violation of the upload policy.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e uploadError) Error() string {
+	return e.msg
+}
+
+// LoadUploadPolicy reads a json upload policy file.
+func LoadUploadPolicy(path string) (*UploadPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read upload policy %s: %v", path, err)
+	}
+
+	p, err := parseUploadPolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse upload policy %s: %v", path, err)
+	}
+
+	return p, nil
+}
+
+func parseUploadPolicy(b []byte) (*UploadPolicy, error) {
+	p := &UploadPolicy{}
+
+	err := json.Unmarshal(b, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range p.Rules {
+		if !strings.HasPrefix(r.Prefix, "/") || !strings.HasSuffix(r.Prefix, "/") {
+			return nil, fmt.Errorf("rule %d: prefix %s needs to start and end with /", i, r.Prefix)
+		}
+
+		if r.MaxSize < 0 {
+			return nil, fmt.Errorf("rule %d: negative maxSize", i)
+		}
+
+		for _, pattern := range append(r.AllowNames, r.DenyNames...) {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: name pattern %s: %v", i, pattern, err)
+			}
+		}
+
+		for _, t := range append(r.AllowTypes, r.DenyTypes...) {
+			if !strings.Contains(t, "/") {
+				return nil, fmt.Errorf("rule %d: media type %s needs to contain /", i, t)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// rule returns the rule applying to filePath, nil if none does.
+func (p *UploadPolicy) rule(filePath string) *UploadRule {
+	if p == nil {
+		return nil
+	}
+
+	var match *UploadRule
+	for i, r := range p.Rules {
+		if strings.HasPrefix(filePath, r.Prefix) && (match == nil || len(r.Prefix) > len(match.Prefix)) {
+			match = &p.Rules[i]
+		}
+	}
+
+	return match
+}
+
+// restrictsContent reports if the rule needs to see the content of a file to decide on it.
+func (r *UploadRule) restrictsContent() bool {
+	return r != nil && (r.MaxSize > 0 || len(r.AllowTypes) > 0 || len(r.DenyTypes) > 0)
+}
+
+func (r *UploadRule) checkName(filePath string) error {
+	if r == nil {
+		return nil
+	}
+
+	name := strings.ToLower(path.Base(filePath))
+
+	for _, pattern := range r.DenyNames {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("file name %s is not allowed below %s", path.Base(filePath), r.Prefix)}
+		}
+	}
+
+	if len(r.AllowNames) == 0 {
+		return nil
+	}
+
+	for _, pattern := range r.AllowNames {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return nil
+		}
+	}
+
+	return uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("file name %s is not allowed below %s", path.Base(filePath), r.Prefix)}
+}
+
+func (r *UploadRule) checkSize(size int64) error {
+	if r == nil || r.MaxSize == 0 || size <= r.MaxSize {
+		return nil
+	}
+
+	return uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("files below %s may not exceed %d bytes", r.Prefix, r.MaxSize)}
+}
+
+// checkType verifies the media type sniffed from the content and the declared one.
+// Both must not be denied, the sniffed one needs to be allowed.
+// If sniffing only recognizes plain text the declared type may be allowed instead.
+func (r *UploadRule) checkType(sniffed, declared string) error {
+	if r == nil {
+		return nil
+	}
+
+	sniffed = mediaType(sniffed)
+	declared = mediaType(declared)
+
+	for _, t := range r.DenyTypes {
+		if matchesType(t, sniffed) || (declared != "" && matchesType(t, declared)) {
+			return uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("media type %s is not allowed below %s", sniffed, r.Prefix)}
+		}
+	}
+
+	if len(r.AllowTypes) == 0 {
+		return nil
+	}
+
+	for _, t := range r.AllowTypes {
+		if matchesType(t, sniffed) || (sniffed == "text/plain" && declared != "" && matchesType(t, declared)) {
+			return nil
+		}
+	}
+
+	return uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("media type %s is not allowed below %s", sniffed, r.Prefix)}
+}
+
+// check verifies a file completely written to f.
+func (r *UploadRule) check(filePath string, f io.ReadSeeker, size int64, declared string) error {
+	if r == nil {
+		return nil
+	}
+
+	err := r.checkName(filePath)
+	if err != nil {
+		return err
+	}
+
+	err = r.checkSize(size)
+	if err != nil {
+		return err
+	}
+
+	sniffed, err := sniff(f)
+	if err != nil {
+		return fmt.Errorf("detect media type: %v", err)
+	}
+
+	return r.checkType(sniffed, declared)
+}
+
+// checkTree verifies the files below the local directory src before they are stored in the directory target.
+func (p *UploadPolicy) checkTree(src, target string) error {
+	if p == nil {
+		return nil
+	}
+
+	return filepath.Walk(src,
+		func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(src, file)
+			if err != nil {
+				return err
+			}
+
+			filePath := target + filepath.ToSlash(rel)
+
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			err = p.rule(filePath).check(filePath, f, info.Size(), mime.TypeByExtension(filepath.Ext(file)))
+			if err != nil {
+				return fmt.Errorf("file %s: %v", rel, err)
+			}
+
+			return nil
+		})
+}
+
+// sniff detects the media type of the content and rewinds it.
+func sniff(f io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// mediaType strips the parameters from a content type.
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	return t
+}
+
+// matchesType reports if the media type matches the pattern, image/* matches every image.
+func matchesType(pattern, t string) bool {
+	pattern = strings.ToLower(pattern)
+
+	if pattern == "*/*" || pattern == t {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(t, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return false
+}
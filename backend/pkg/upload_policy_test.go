@@ -0,0 +1,86 @@
+package dinghy
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+const testUploadPolicy = `{
+  "rules": [
+    {"prefix": "/", "maxSize": 1024, "denyTypes": ["application/x-msdownload"], "denyNames": ["*.exe", "*.bat"]},
+    {"prefix": "/photos/", "maxSize": 64, "allowTypes": ["image/*"]},
+    {"prefix": "/reports/", "allowTypes": ["text/csv", "application/pdf"], "allowNames": ["*.csv", "*.pdf"]}
+  ]
+}`
+
+var (
+	pngHeader = []byte("\x89PNG\r\n\x1a\n")
+	pdfHeader = []byte("%PDF-1.4\n")
+	zipHeader = []byte("PK\x03\x04")
+)
+
+func TestUploadRule_check(t *testing.T) {
+	p, err := parseUploadPolicy([]byte(testUploadPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		content    []byte
+		declared   string
+		wantStatus int
+	}{
+		{"small text file", "/notes.txt", []byte("hello"), "text/plain", 0},
+		{"too large", "/notes.txt", bytes.Repeat([]byte("a"), 1025), "text/plain", http.StatusRequestEntityTooLarge},
+		{"denied name", "/setup.EXE", []byte("MZ"), "", http.StatusUnsupportedMediaType},
+		{"denied declared type", "/setup", []byte("MZ"), "application/x-msdownload", http.StatusUnsupportedMediaType},
+		{"image in photos", "/photos/a.png", pngHeader, "image/png", 0},
+		{"longest prefix applies", "/photos/a.png", append(pngHeader, bytes.Repeat([]byte("a"), 64)...), "image/png", http.StatusRequestEntityTooLarge},
+		{"archive disguised as image", "/photos/a.png", zipHeader, "image/png", http.StatusUnsupportedMediaType},
+		{"declared text refines sniffed text", "/reports/q1.csv", []byte("a,b\n1,2\n"), "text/csv; charset=utf-8", 0},
+		{"declared type does not override binary", "/reports/q1.csv", zipHeader, "text/csv", http.StatusUnsupportedMediaType},
+		{"pdf report", "/reports/q1.pdf", pdfHeader, "", 0},
+		{"name not allowed", "/reports/q1.txt", []byte("a,b"), "text/csv", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.rule(tt.path).check(tt.path, bytes.NewReader(tt.content), int64(len(tt.content)), tt.declared)
+
+			status := 0
+			uerr := uploadError{}
+			if errors.As(err, &uerr) {
+				status = uerr.status
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != tt.wantStatus {
+				t.Errorf("UploadRule.check() = %v, want status %v", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_parseUploadPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{"relative prefix", `{"rules": [{"prefix": "photos/"}]}`},
+		{"negative size", `{"rules": [{"prefix": "/", "maxSize": -1}]}`},
+		{"bad pattern", `{"rules": [{"prefix": "/", "denyNames": ["[a-"]}]}`},
+		{"bad media type", `{"rules": [{"prefix": "/", "allowTypes": ["image"]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUploadPolicy([]byte(tt.policy))
+			if err == nil {
+				t.Errorf("parseUploadPolicy() accepted %s", tt.policy)
+			}
+		})
+	}
+}
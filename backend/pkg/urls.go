@@ -0,0 +1,28 @@
+package dinghy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// escapePath percent-encodes every segment of a slash separated path,
+// the slashes between the segments are kept.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// fileURL returns the url of the file at path relative to the root of the service,
+// flags are appended as query parameters without values.
+func fileURL(path string, flags ...string) string {
+	u := escapePath(strings.TrimPrefix(path, "/"))
+	if len(flags) > 0 {
+		u += "?" + strings.Join(flags, "&")
+	}
+
+	return u
+}
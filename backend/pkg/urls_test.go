@@ -0,0 +1,125 @@
+package dinghy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var nastyPaths = []string{
+	"/plain.txt",
+	"/with space.jpg",
+	"/hash#tag.jpg",
+	"/question?.jpg",
+	"/percent%20.jpg",
+	"/and&thumbnail.jpg",
+	"/equal=1.jpg",
+	"/plus+minus.jpg",
+	"/semi;colon.jpg",
+	"/colon:first.jpg",
+	"/café/日本.png",
+	"/dir with space/file#1?.jpg",
+}
+
+func Test_fileURL(t *testing.T) {
+	for _, p := range nastyPaths {
+		t.Run(p, func(t *testing.T) {
+			got := fileURL(p, "redirect", "thumbnail")
+
+			r := httptest.NewRequest(http.MethodGet, "/"+got, nil)
+			if r.URL.Path != p {
+				t.Errorf("fileURL() = %v, path = %v, want %v", got, r.URL.Path, p)
+			}
+
+			redirect, thumbnail, err := parseRequest(r.URL.RawQuery)
+			if err != nil || !redirect || !thumbnail {
+				t.Errorf("fileURL() = %v, query = %v, want redirect&thumbnail", got, r.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func Test_respond_redirect(t *testing.T) {
+	for _, p := range nastyPaths {
+		t.Run(p, func(t *testing.T) {
+			dir := p[:strings.LastIndex(p, "/")+1]
+
+			r := httptest.NewRequest(http.MethodGet, "/"+fileURL(dir), nil)
+			w := httptest.NewRecorder()
+
+			err := respond(w, r, Directory{}, "https://frontend.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if location.Path != dir || location.RawQuery != "" || location.Fragment != "" {
+				t.Errorf("respond() location = %v, want path %v", location, dir)
+			}
+		})
+	}
+}
+
+func Test_toTXT(t *testing.T) {
+	l := Directory{
+		Path:        "a&b/",
+		Directories: []string{"<dir>"},
+		Files:       []File{{Name: "it's \"quoted\".txt", Size: 3}},
+	}
+
+	b := &strings.Builder{}
+
+	err := l.toTXT(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "/a&b/:\n<dir>/\nit's \"quoted\".txt (3 Byte)\n"
+	if b.String() != want {
+		t.Errorf("toTXT() = %q, want %q", b.String(), want)
+	}
+}
+
+func TestMinioAdapter_presign(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+		Endpoint:         aws.String("http://minio.example.com"),
+		Region:           aws.String("us-east-1"),
+		S3ForcePathStyle: aws.Bool(true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MinioAdapter{Client: s3.New(sess), Bucket: "bucket"}
+
+	for _, p := range nastyPaths {
+		t.Run(p, func(t *testing.T) {
+			got, err := m.presign(context.Background(), http.MethodGet, filesDirectory+p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := url.Parse(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if u.Path != "/bucket/"+filesDirectory+p || u.Query().Get("X-Amz-Signature") == "" {
+				t.Errorf("presign() = %v, path %v", got, u.Path)
+			}
+		})
+	}
+}
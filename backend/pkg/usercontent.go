@@ -0,0 +1,182 @@
+package dinghy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+const userContentPrefix = "/uc/"
+
+// userContentCSP lets uploaded pages run scripts in an opaque origin without access to the api.
+const userContentCSP = "sandbox allow-scripts allow-forms allow-popups; default-src 'self' 'unsafe-inline' data: blob:; connect-src 'none'; frame-ancestors 'none'"
+
+// attachmentCSP stops scriptable documents which are opened nevertheless.
+const attachmentCSP = "sandbox; default-src 'none'"
+
+// UserContent renders scriptable files like html pages on a separate origin.
+// The backend redirects to short lived urls signed for a single file and the user who opened it,
+// the file is only delivered while the user may still read it.
+type UserContent struct {
+	URL *url.URL
+	Key []byte
+	TTL time.Duration
+}
+
+// handles reports if the request was sent to the user content origin.
+func (uc *UserContent) handles(r *http.Request) bool {
+	return uc != nil && strings.EqualFold(r.Host, uc.URL.Host)
+}
+
+// sign returns the url rendering the file for the user on the user content origin.
+func (uc *UserContent) sign(filePath string, u auth.User, now time.Time) (string, error) {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", fmt.Errorf("encode user: %v", err)
+	}
+
+	expires := now.Add(uc.TTL).Unix()
+	user := base64.RawURLEncoding.EncodeToString(b)
+
+	token := fmt.Sprintf("%d.%s.%s", expires, user, uc.mac(expires, user, filePath))
+
+	return strings.TrimSuffix(uc.URL.String(), "/") + userContentPrefix + token + escapePath(filePath), nil
+}
+
+// verify checks the token of a user content path and returns the path of the file
+// and the user the url was signed for.
+func (uc *UserContent) verify(p string, now time.Time) (string, auth.User, bool) {
+	token, filePath, found := strings.Cut(strings.TrimPrefix(p, userContentPrefix), "/")
+	if !found {
+		return "", auth.User{}, false
+	}
+	filePath = "/" + filePath
+
+	fields := strings.Split(token, ".")
+	if len(fields) != 3 {
+		return "", auth.User{}, false
+	}
+
+	expires, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", auth.User{}, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(fields[2]), []byte(uc.mac(expires, fields[1], filePath))) != 1 {
+		return "", auth.User{}, false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", auth.User{}, false
+	}
+
+	u := auth.User{}
+
+	err = json.Unmarshal(b, &u)
+	if err != nil {
+		return "", auth.User{}, false
+	}
+
+	return filePath, u, true
+}
+
+func (uc *UserContent) mac(expires int64, user, filePath string) string {
+	mac := hmac.New(sha256.New, uc.Key)
+	fmt.Fprintf(mac, "%d.%s.%s", expires, user, filePath)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsPublic reports if the request needs no authentication.
+// Shares and user content urls carry their own signature.
+func (s *ServiceServer) IsPublic(r *http.Request) bool {
+	return IsShareAccess(r) || s.UserContent.handles(r)
+}
+
+// serveUserContent delivers files on the user content origin.
+func (s *ServiceServer) serveUserContent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	filePath, u, ok := s.UserContent.verify(r.URL.Path, time.Now())
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !s.Policy.allowed(u, PermissionRead, filePath) {
+		log.Printf("GET user content %s: forbidden for user %s", filePath, u.Name)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ctx := r.Context()
+
+	found, etag, contentType, err := s.Storage.exists(ctx, filesDirectory+filePath)
+	if err != nil {
+		log.Printf("GET user content %s: %v", filePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !found || strings.HasSuffix(filePath, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if s.rejectUnscanned(w, r, filePath) {
+		return
+	}
+
+	err = s.download(ctx, filePath, etag, contentType, false, w, r)
+	if err != nil {
+		log.Printf("GET user content %s: %v", filePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// contentHeaders protects the origin delivering a file from its content.
+// Browsers must not guess types, scriptable documents are isolated or downloaded.
+func contentHeaders(h http.Header, filePath, contentType string, isolated bool) {
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if isolated {
+		h.Set("Content-Security-Policy", userContentCSP)
+		h.Set("Referrer-Policy", "no-referrer")
+		return
+	}
+
+	if scriptable(contentType) {
+		h.Set("Content-Security-Policy", attachmentCSP)
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filePath)}))
+	}
+}
+
+// scriptable reports if browsers may execute scripts of a document of the type.
+func scriptable(contentType string) bool {
+	t := mediaType(contentType)
+
+	switch t {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml", "text/xsl", "application/xslt+xml":
+		return true
+	}
+
+	return strings.HasSuffix(t, "+xml")
+}
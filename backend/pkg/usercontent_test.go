@@ -0,0 +1,150 @@
+package dinghy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
+)
+
+func TestUserContent_verify(t *testing.T) {
+	u, _ := url.Parse("https://usercontent.example.com")
+	uc := &UserContent{URL: u, Key: []byte("0123456789abcdef0123456789abcdef"), TTL: time.Hour}
+
+	alice := auth.User{Name: "alice", Groups: []string{"dev"}}
+
+	now := time.Now()
+	signed, err := uc.sign("/site/docs/index #1.html", alice, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := strings.Split(strings.TrimPrefix(signed, "https://usercontent.example.com"+userContentPrefix), "/")[0]
+
+	other, err := uc.sign("/site/docs/index #1.html", auth.User{Name: "admin", Groups: []string{"admins"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUser := strings.Split(strings.Split(other, userContentPrefix)[1], ".")[1]
+	fields := strings.Split(token, ".")
+	swapped := fields[0] + "." + otherUser + "." + fields[2]
+
+	tests := []struct {
+		name     string
+		path     string
+		now      time.Time
+		wantPath string
+		wantOK   bool
+	}{
+		{"signed file", userContentPrefix + token + "/site/docs/index #1.html", now, "/site/docs/index #1.html", true},
+		{"sibling in directory", userContentPrefix + token + "/site/docs/style.css", now, "", false},
+		{"below directory", userContentPrefix + token + "/site/docs/js/app.js", now, "", false},
+		{"parent directory", userContentPrefix + token + "/site/secret.html", now, "", false},
+		{"expired", userContentPrefix + token + "/site/docs/index #1.html", now.Add(2 * time.Hour), "", false},
+		{"tampered expiry", userContentPrefix + "9" + token + "/site/docs/index #1.html", now, "", false},
+		{"tampered user", userContentPrefix + swapped + "/site/docs/index #1.html", now, "", false},
+		{"no token", userContentPrefix + "site/docs/index.html", now, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotUser, ok := uc.verify(tt.path, tt.now)
+			if ok != tt.wantOK || got != tt.wantPath {
+				t.Errorf("UserContent.verify() = %v, %v, want %v, %v", got, ok, tt.wantPath, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(gotUser, alice) {
+				t.Errorf("UserContent.verify() user = %v, want %v", gotUser, alice)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, signed, nil)
+	if !uc.handles(r) {
+		t.Errorf("UserContent.handles(%s) = false", signed)
+	}
+	if got, _, ok := uc.verify(r.URL.Path, now); !ok || got != "/site/docs/index #1.html" {
+		t.Errorf("UserContent.verify(%s) = %v, %v", r.URL.Path, got, ok)
+	}
+}
+
+func TestServiceServer_serveUserContent(t *testing.T) {
+	policy, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("https://usercontent.example.com")
+	uc := &UserContent{URL: u, Key: []byte("0123456789abcdef0123456789abcdef"), TTL: time.Hour}
+
+	fake := &fakeS3{objects: map[string][]byte{
+		"/bucket/files/projects/apollo/index.html": []byte("<h1>apollo</h1>"),
+		"/bucket/files/secret/index.html":          []byte("<h1>secret</h1>"),
+	}}
+
+	s := NewServiceServer()
+	s.Storage = fakeStorage(t, fake)
+	s.Policy = policy
+	s.UserContent = uc
+
+	tests := []struct {
+		name     string
+		path     string
+		user     auth.User
+		wantCode int
+	}{
+		{"readable file", "/projects/apollo/index.html", auth.User{Name: "alice"}, http.StatusOK},
+		{"file not readable by the user", "/secret/index.html", auth.User{Name: "alice"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := uc.sign(tt.path, tt.user, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, signed, nil))
+
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if w.Code == http.StatusOK && w.Header().Get("Content-Security-Policy") != userContentCSP {
+				t.Errorf("csp = %v", w.Header().Get("Content-Security-Policy"))
+			}
+		})
+	}
+}
+
+func Test_contentHeaders(t *testing.T) {
+	tests := []struct {
+		name            string
+		contentType     string
+		isolated        bool
+		wantDisposition string
+		wantCSP         string
+	}{
+		{"image inline", "image/png", false, "", ""},
+		{"html downloaded", "text/html; charset=utf-8", false, "attachment; filename=page.html", attachmentCSP},
+		{"svg downloaded", "image/svg+xml", false, "attachment; filename=page.html", attachmentCSP},
+		{"html isolated", "text/html", true, "", userContentCSP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			contentHeaders(h, "/dir/page.html", tt.contentType, tt.isolated)
+
+			if h.Get("X-Content-Type-Options") != "nosniff" {
+				t.Errorf("contentHeaders() nosniff missing")
+			}
+			if got := h.Get("Content-Disposition"); got != tt.wantDisposition {
+				t.Errorf("contentHeaders() disposition = %v, want %v", got, tt.wantDisposition)
+			}
+			if got := h.Get("Content-Security-Policy"); got != tt.wantCSP {
+				t.Errorf("contentHeaders() csp = %v, want %v", got, tt.wantCSP)
+			}
+		})
+	}
+}
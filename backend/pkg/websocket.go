@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"gitlab.com/davedamoon/dinghy/backend/pkg/auth"
 )
 
 const (
@@ -32,12 +33,15 @@ func (s ServiceServer) serveWs(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
 	go s.writer(ctx, ws, msg)
-	s.reader(ctx, ws, msg)
+	s.reader(ctx, ws, msg, r)
 
 	return nil
 }
 
-func (s ServiceServer) reader(ctx context.Context, ws *websocket.Conn, msg chan<- string) {
+// reader executes the commands of the client, r is the request which opened the websocket.
+func (s ServiceServer) reader(ctx context.Context, ws *websocket.Conn, msg chan<- string, r *http.Request) {
+	client := s.Limiter.Client(r)
+
 	ws.SetReadLimit(512)
 
 	err := ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -65,40 +69,95 @@ func (s ServiceServer) reader(ctx context.Context, ws *websocket.Conn, msg chan<
 			break
 		}
 
+		if len(m) < 3 {
+			log.Printf("websocket command %q not supported", m)
+			continue
+		}
+
+		_, ok := s.Limiter.Allow(auth.ClassWebsocket, client)
+		if !ok {
+			log.Printf("websocket command %q: rate limited %s", m, client)
+			continue
+		}
+
 		switch string(m[0:3]) {
 		case "cd ":
-			msg <- string(m[3:])
+			path, err := canonicalDirectory(string(m[3:]))
+			if err != nil {
+				log.Printf("change directory to %q: %v", m[3:], err)
+				continue
+			}
+
+			if !s.Policy.traversable(userFromContext(ctx), path) {
+				log.Printf("change directory to %s: forbidden", path)
+				continue
+			}
+
+			msg <- path
 		case "ex ":
+			path, err := canonicalPath(string(m[3:]))
+			if err != nil {
+				log.Printf("extract %q: %v", m[3:], err)
+				continue
+			}
+
+			if !s.mayExtract(ctx, path) {
+				log.Printf("extract %s: forbidden", path)
+				continue
+			}
+
 			go func(path string) {
 				err := s.unzip(ctx, path)
+				s.audit(r, AuditExtract, path, 0, auditResult(err), err)
 				if err != nil {
 					log.Printf("extract %s: %v", path, err)
 				}
-				s.Notify.notify(ctx)
-			}(string(m[3:]))
+
+				target, _ := extractTarget(path)
+				s.notifyChange(ctx, eventCreated, target, 0)
+			}(path)
 		case "rm ":
-			path := string(m[3:])
+			path, err := canonicalPath(string(m[3:]))
+			if err != nil {
+				log.Printf("deleting %q: %v", m[3:], err)
+				continue
+			}
 
-			err := s.Storage.deleteRecursive(ctx, path)
+			if path == "/" {
+				log.Printf("deleting %s: refusing to delete the root directory", path)
+				continue
+			}
+
+			if !s.allowed(ctx, PermissionDelete, path) {
+				log.Printf("deleting %s: forbidden", path)
+				continue
+			}
+
+			err = s.Storage.deleteRecursive(ctx, path)
+			s.audit(r, AuditDelete, path, 0, auditResult(err), err)
 			if err != nil {
 				log.Printf("deleting %s: %v", path, err)
 			}
 
-			s.Notify.notify(ctx)
+			s.notifyChange(ctx, eventRemoved, path, 0)
 		}
-
 	}
 }
 
 func (s ServiceServer) writer(ctx context.Context, ws *websocket.Conn, msg <-chan string) {
 	pingTicker := time.NewTicker(pingPeriod)
 	notify := s.Notify.listen(ctx)
+	throttle := &relistThrottle{interval: s.RelistInterval}
+	poll := time.NewTicker(s.Notify.pollInterval())
 
 	path := ""
+	pollHash := ""
 	var previous *Directory
 
 	defer func() {
 		pingTicker.Stop()
+		throttle.stop()
+		poll.Stop()
 	}()
 
 	for {
@@ -119,11 +178,16 @@ func (s ServiceServer) writer(ctx context.Context, ws *websocket.Conn, msg <-cha
 				log.Println(err)
 				return
 			}
-		case <-notify:
+		case e := <-notify:
 			if len(path) == 0 {
 				continue
 			}
 
+			wake, check := wakes(e, path, previous)
+			if !wake || !throttle.wake(check) || !s.relistNeeded(ctx, path, throttle) {
+				continue
+			}
+
 			cur, err := s.sendUpdate(ctx, ws, previous, path)
 			if err != nil {
 				log.Println(err)
@@ -131,11 +195,40 @@ func (s ServiceServer) writer(ctx context.Context, ws *websocket.Conn, msg <-cha
 			}
 
 			previous = cur
+			throttle.listed()
+		case <-poll.C:
+			if len(path) == 0 || !s.polledChange(ctx, path, &pollHash) {
+				continue
+			}
+
+			cur, err := s.sendUpdate(ctx, ws, previous, path)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			previous = cur
+			throttle.listed()
+		case <-throttle.C:
+			if !s.relistNeeded(ctx, path, throttle) {
+				continue
+			}
+
+			cur, err := s.sendUpdate(ctx, ws, previous, path)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+
+			previous = cur
+			throttle.listed()
 		case path = <-msg:
 			if len(path) == 0 {
 				return
 			}
 
+			pollHash = ""
+
 			cur, err := s.sendUpdate(ctx, ws, nil, path)
 			if err != nil {
 				log.Println(err)
@@ -143,16 +236,19 @@ func (s ServiceServer) writer(ctx context.Context, ws *websocket.Conn, msg <-cha
 			}
 
 			previous = cur
+			throttle.listed()
 		}
 	}
 }
 
 func (s ServiceServer) sendUpdate(ctx context.Context, ws *websocket.Conn, previous *Directory, path string) (*Directory, error) {
-	listing, err := s.Storage.list(ctx, path)
+	listing, err := s.listing(ctx, path)
 	if err != nil {
 		return nil, fmt.Errorf("list %s: %v", path, err)
 	}
 
+	listing = s.Policy.filter(userFromContext(ctx), listing)
+
 	if reflect.DeepEqual(previous, &listing) {
 		return &listing, nil
 	}
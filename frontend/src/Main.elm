@@ -215,7 +215,7 @@ update msg model =
             mdl = { model | url = url, fetching = Loading }
         in
             mdl
-            |> withCmds [ WebSocket.makeSend mdl.key ( "cd " ++ mdl.url.path ) |> send mdl
+            |> withCmds [ WebSocket.makeSend mdl.key ( "cd " ++ currentPath mdl.url ) |> send mdl
                         , delay 500 (LoadingIsSlow mdl.url.path)
                         ]
 
@@ -239,6 +239,12 @@ update msg model =
         |> withCmd (saveViewFormat fmtStr)
 
 
+currentPath : Url.Url -> String
+currentPath url =
+  Url.percentDecode url.path
+  |> Maybe.withDefault url.path
+
+
 send : Model -> WebSocket.Message -> Cmd Msg
 send model message =
     WebSocket.send (getCmdPort WebSocket.moduleName model) message
@@ -280,7 +286,7 @@ socketHandler response state mdl =
 
         WebSocket.ConnectedResponse _ ->
             model
-            |> withCmds [ WebSocket.makeSend model.key ( "cd " ++ model.url.path ) |> send model
+            |> withCmds [ WebSocket.makeSend model.key ( "cd " ++ currentPath model.url ) |> send model
                         , delay 500 (LoadingIsSlow model.url.path)
                         ]
 
@@ -299,7 +305,7 @@ socketHandler response state mdl =
 
                 [ ReconnectedResponse _ ] ->
                     model
-                        |> withCmds [ WebSocket.makeSend model.key ( "cd " ++ model.url.path ) |> send model
+                        |> withCmds [ WebSocket.makeSend model.key ( "cd " ++ currentPath model.url ) |> send model
                                     , delay 500 (LoadingIsSlow model.url.path)
                                     ]
 
@@ -396,7 +402,7 @@ navigationElements previous elements =
       Nothing ->
         ""
       Just name ->
-        previous ++ name ++ "/"
+        previous ++ Url.percentEncode name ++ "/"
     t = List.tail elements
     ls = case t of
       Nothing ->
@@ -454,7 +460,7 @@ viewFolder path name =
     [ class "element" ]
     [ div 
       [ class "element-inner" ]
-      [ a [ href (name++"/") ]
+      [ a [ href (Url.percentEncode name ++ "/") ]
           [ div
             [ class "thumbnail" ]
             [ span[ class "fiv-sqo fiv-icon-folder fiv-icon" ] [] ]
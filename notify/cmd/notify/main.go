@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
@@ -10,20 +12,22 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/nats-io/nats.go"
 	otgrpc "github.com/opentracing-contrib/go-grpc"
 	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/uber/jaeger-client-go/config"
 	cli "github.com/urfave/cli/v2"
 	notify "gitlab.com/davedamoon/dinghy/notify/pkg"
 	"gitlab.com/davedamoon/dinghy/notify/pkg/middleware"
 	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
@@ -45,7 +49,32 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "http", Value: ":8080", Usage: "Address for server."},
 					&cli.StringFlag{Name: "grpc", Value: ":50051", Usage: "Address for server."},
-					&cli.StringFlag{Name: "webhook-token-file", Required: true, Usage: "Path to webhook token file."},
+					&cli.StringFlag{Name: "tls-cert-file", Usage: "Path to pem certificate serving http and grpc with TLS, reloaded on change."},
+					&cli.StringFlag{Name: "tls-key-file", Usage: "Path to pem key of the certificate."},
+					&cli.StringFlag{Name: "grpc-client-ca-file", Usage: "Path to pem CA, grpc clients need to present a certificate signed by it."},
+					&cli.IntFlag{Name: "replay-buffer", Value: 10000, Usage: "Number of events kept for subscribers resuming after a reconnect."},
+					&cli.StringFlag{Name: "replay-file", Usage: "Path to persist the replay buffer across restarts."},
+					&cli.DurationFlag{Name: "coalesce-window", Value: 200 * time.Millisecond, Usage: "Time events of a directory are held back to merge repeated changes of the same object, 0 disables it."},
+					&cli.StringSliceFlag{Name: "peers", Usage: "Addresses of the grpc servers of other notify replicas to forward events to."},
+					&cli.StringFlag{Name: "peer-discovery", Usage: "host:port of all notify replicas, like a headless service, resolved to find peers."},
+					&cli.DurationFlag{Name: "peer-discovery-interval", Value: 30 * time.Second, Usage: "Interval to resolve peer-discovery."},
+					&cli.BoolFlag{Name: "peer-tls", Usage: "Connect to peers with TLS."},
+					&cli.StringFlag{Name: "peer-ca-file", Usage: "Path to pem CA verifying peers instead of the system roots."},
+					&cli.StringFlag{Name: "peer-cert-file", Usage: "Path to pem client certificate for mutual TLS with peers."},
+					&cli.StringFlag{Name: "peer-key-file", Usage: "Path to pem key of the client certificate."},
+					&cli.StringFlag{Name: "peer-server-name", Usage: "Name expected in the certificates of peers, required with peer-ca-file."},
+					&cli.StringSliceFlag{Name: "events", Value: cli.NewStringSlice(notify.DefaultEvents...), Usage: "Patterns of the s3 event names which are published, like s3:ObjectCreated:*."},
+					&cli.StringFlag{Name: "outbound-webhooks-file", Usage: "Path to json list of endpoints receiving the events."},
+					&cli.StringFlag{Name: "outbound-dead-letter-file", Usage: "Path to log events which could not be delivered to endpoints, defaults to stderr."},
+					&cli.StringFlag{Name: "nats-url", Usage: "URL of a nats server to consume bucket notifications from, in addition to the webhook."},
+					&cli.StringFlag{Name: "nats-subject", Value: "bucketevents", Usage: "Subject MinIO publishes the notifications to."},
+					&cli.StringFlag{Name: "nats-queue", Value: "notify", Usage: "Queue group shared by the replicas, so every notification is published once."},
+					&cli.BoolFlag{Name: "nats-jetstream", Usage: "Consume from a JetStream stream, notifications sent while notify is down are not lost."},
+					&cli.StringFlag{Name: "nats-durable", Value: "notify", Usage: "Name of the durable JetStream consumer."},
+					&cli.StringFlag{Name: "nats-creds-file", Usage: "Path to nats user credentials."},
+					&cli.StringFlag{Name: "webhook-token-file", Usage: "Path to webhook token file, one token per line."},
+					&cli.DurationFlag{Name: "webhook-token-reload", Value: 30 * time.Second, Usage: "Interval to check the webhook token file for changes."},
+					&cli.StringFlag{Name: "webhook-hmac-key-file", Usage: "Path to key verifying the X-Signature-256 header of webhook calls."},
 				},
 				Action: run,
 			},
@@ -75,17 +104,41 @@ func run(c *cli.Context) error {
 	log.Printf("version: %v", gitRef)
 	log.Printf("git commit: %v", gitHash)
 
-	tokenBytes, err := os.ReadFile(c.String("webhook-token-file"))
-	if err != nil {
-		return fmt.Errorf("reading webhook token from %s: %v", c.String("webhook-token-file"), err)
+	if c.String("webhook-token-file") == "" && c.String("webhook-hmac-key-file") == "" {
+		return fmt.Errorf("webhook-token-file or webhook-hmac-key-file is required")
 	}
 
-	token := strings.TrimSpace(string(tokenBytes))
+	var tokens *notify.WebhookTokens
+	var err error
+	if c.String("webhook-token-file") != "" {
+		tokens, err = notify.LoadWebhookTokens(c.String("webhook-token-file"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var hmacKey []byte
+	if c.String("webhook-hmac-key-file") != "" {
+		key, err := os.ReadFile(c.String("webhook-hmac-key-file"))
+		if err != nil {
+			return fmt.Errorf("reading webhook hmac key from %s: %v", c.String("webhook-hmac-key-file"), err)
+		}
+
+		hmacKey = bytes.TrimSpace(key)
+		if len(hmacKey) == 0 {
+			return fmt.Errorf("webhook hmac key %s is empty", c.String("webhook-hmac-key-file"))
+		}
+	}
 
 	log.Println("set up metrics")
 
 	middleware.InitMetrics(gitHash, gitRef)
 
+	err = notify.RegisterMetrics(prometheus.DefaultRegisterer)
+	if err != nil {
+		return fmt.Errorf("register metrics: %v", err)
+	}
+
 	log.Println("set up tracing")
 
 	jaeger, err := setupJaeger()
@@ -94,36 +147,126 @@ func run(c *cli.Context) error {
 	}
 	defer jaeger.Close()
 
+	var httpTLS, grpcTLS *tls.Config
+	if c.String("tls-cert-file") != "" || c.String("tls-key-file") != "" {
+		httpTLS, err = middleware.ServerTLSConfig(c.String("tls-cert-file"), c.String("tls-key-file"), "")
+		if err != nil {
+			return fmt.Errorf("setup tls: %v", err)
+		}
+
+		grpcTLS, err = middleware.ServerTLSConfig(c.String("tls-cert-file"), c.String("tls-key-file"), c.String("grpc-client-ca-file"))
+		if err != nil {
+			return fmt.Errorf("setup grpc tls: %v", err)
+		}
+	} else if c.String("grpc-client-ca-file") != "" {
+		return fmt.Errorf("grpc-client-ca-file requires tls-cert-file and tls-key-file")
+	}
+
 	log.Println("set up servers")
 
-	m := sync.Mutex{}
-	cond := sync.NewCond(&m)
+	if c.Int("replay-buffer") < 0 {
+		return fmt.Errorf("replay-buffer must not be negative")
+	}
+
+	broker := notify.NewBroker(c.Int("replay-buffer"))
+	if c.String("replay-file") != "" {
+		if c.Int("replay-buffer") < 1 {
+			return fmt.Errorf("replay-file requires a replay-buffer")
+		}
+
+		broker, err = notify.OpenBroker(c.Int("replay-buffer"), c.String("replay-file"))
+		if err != nil {
+			return fmt.Errorf("restore replay buffer: %v", err)
+		}
+	}
+	defer broker.Close()
+
+	broker.CoalesceWindow = c.Duration("coalesce-window")
+
+	if c.String("outbound-webhooks-file") != "" {
+		webhooks, closeWebhooks, err := setupWebhooks(c)
+		if err != nil {
+			return fmt.Errorf("setup outbound webhooks: %v", err)
+		}
+		defer closeWebhooks()
+
+		broker.Webhooks = webhooks
+	}
+
+	if len(c.StringSlice("peers")) > 0 || c.String("peer-discovery") != "" {
+		peers, err := setupPeers(c)
+		if err != nil {
+			return fmt.Errorf("setup peers: %v", err)
+		}
+		defer peers.Close()
+
+		broker.Peers = peers
+	}
+
+	// deliver the events held back before peers and webhooks are closed
+	defer broker.Flush()
 
 	grpcServce := &notify.GRPCServer{}
-	grpcServce.C = cond
+	grpcServce.Broker = broker
 
 	httpSrv := notify.NewServer()
-	httpSrv.BearerToken = token
-	httpSrv.C = cond
+	httpSrv.Tokens = tokens
+	httpSrv.HMACKey = hmacKey
+	httpSrv.Events, err = notify.NewEventFilter(c.StringSlice("events"))
+	if err != nil {
+		return fmt.Errorf("setup event filter: %v", err)
+	}
+	httpSrv.Broker = broker
+
+	if c.String("nats-url") != "" {
+		nc, err := setupNATS(c, &notify.NATSConsumer{
+			Broker:    broker,
+			Events:    httpSrv.Events,
+			Queue:     c.String("nats-queue"),
+			JetStream: c.Bool("nats-jetstream"),
+			Durable:   c.String("nats-durable"),
+		})
+		if err != nil {
+			return fmt.Errorf("setup nats: %v", err)
+		}
+		defer nc.Close()
+	}
+
 	svcHandler := middleware.RequestID(rand.Int63, httpSrv)
 	svcHandler = middleware.InitTraceContext(svcHandler)
 	svcHandler = middleware.InstrumentHttpHandler(svcHandler)
 	svcHandler = middleware.Timeout(29*time.Second, svcHandler)
 
 	tracer := opentracing.GlobalTracer()
-	grpcS := grpc.NewServer(
+	grpcOptions := []grpc.ServerOption{
 		grpc.ChainUnaryInterceptor(
 			grpc_prometheus.UnaryServerInterceptor,
 			otgrpc.OpenTracingServerInterceptor(tracer)),
 		grpc.ChainStreamInterceptor(
 			grpc_prometheus.StreamServerInterceptor,
-			otgrpc.OpenTracingStreamServerInterceptor(tracer)))
+			otgrpc.OpenTracingStreamServerInterceptor(tracer)),
+	}
+	if grpcTLS != nil {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(grpcTLS)))
+	}
+	grpcS := grpc.NewServer(grpcOptions...)
 	pb.RegisterNotifierServer(grpcS, grpcServce)
 	grpc_prometheus.Register(grpcS)
 	grpc_health_v1.RegisterHealthServer(grpcS, health.NewServer())
 	reflection.Register(grpcS)
 
-	httpS := httpServer(svcHandler, c.String("http"))
+	httpS := httpServer(svcHandler, c.String("http"), httpTLS)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if tokens != nil {
+		go tokens.Watch(ctx, c.Duration("webhook-token-reload"))
+	}
+
+	if broker.Peers != nil && c.String("peer-discovery") != "" {
+		go broker.Peers.Discover(ctx, c.String("peer-discovery"), c.Duration("peer-discovery-interval"))
+	}
 
 	log.Println("starting grpc server")
 
@@ -137,7 +280,7 @@ func run(c *cli.Context) error {
 
 	awaitShutdown()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	err = httpS.Shutdown(ctx)
@@ -152,6 +295,106 @@ func run(c *cli.Context) error {
 	return nil
 }
 
+func setupWebhooks(c *cli.Context) (*notify.Webhooks, func(), error) {
+	endpoints, err := notify.LoadWebhookEndpoints(c.String("outbound-webhooks-file"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deadLetter := io.WriteCloser(os.Stderr)
+	if c.String("outbound-dead-letter-file") != "" {
+		deadLetter, err = os.OpenFile(c.String("outbound-dead-letter-file"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open dead letter log: %v", err)
+		}
+	}
+
+	webhooks, err := notify.NewWebhooks(endpoints, deadLetter)
+	if err != nil {
+		deadLetter.Close()
+		return nil, nil, err
+	}
+
+	closeWebhooks := func() {
+		webhooks.Close()
+
+		if deadLetter != os.Stderr {
+			deadLetter.Close()
+		}
+	}
+
+	return webhooks, closeWebhooks, nil
+}
+
+func setupPeers(c *cli.Context) (*notify.Peers, error) {
+	if len(c.StringSlice("peers")) > 0 && c.String("peer-discovery") != "" {
+		return nil, fmt.Errorf("peers and peer-discovery are mutually exclusive")
+	}
+
+	creds := insecure.NewCredentials()
+	if c.Bool("peer-tls") {
+		cfg, err := middleware.ClientTLSConfig(
+			c.String("peer-ca-file"),
+			c.String("peer-cert-file"),
+			c.String("peer-key-file"),
+			c.String("peer-server-name"))
+		if err != nil {
+			return nil, fmt.Errorf("setup peer tls: %v", err)
+		}
+		creds = credentials.NewTLS(cfg)
+	}
+
+	tracer := opentracing.GlobalTracer()
+
+	peers := notify.NewPeers(func(addr string) (pb.NotifierClient, io.Closer, error) {
+		conn, err := grpc.Dial(
+			addr,
+			grpc.WithTransportCredentials(creds),
+			grpc.WithChainUnaryInterceptor(
+				grpc_prometheus.UnaryClientInterceptor,
+				otgrpc.OpenTracingClientInterceptor(tracer)),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return pb.NewNotifierClient(conn), conn, nil
+	})
+
+	peers.Set(c.StringSlice("peers"))
+
+	return peers, nil
+}
+
+func setupNATS(c *cli.Context, consumer *notify.NATSConsumer) (*nats.Conn, error) {
+	options := []nats.Option{
+		nats.Name("notify"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("nats disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("nats reconnected to %s", nc.ConnectedUrl())
+		}),
+	}
+	if c.String("nats-creds-file") != "" {
+		options = append(options, nats.UserCredentials(c.String("nats-creds-file")))
+	}
+
+	nc, err := nats.Connect(c.String("nats-url"), options...)
+	if err != nil {
+		return nil, fmt.Errorf("connect %s: %v", c.String("nats-url"), err)
+	}
+
+	_, err = consumer.Subscribe(nc, c.String("nats-subject"))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return nc, nil
+}
+
 func setupJaeger() (io.Closer, error) {
 	cfg, err := config.FromEnv()
 	if err != nil {
@@ -168,10 +411,11 @@ func setupJaeger() (io.Closer, error) {
 	return closer, nil
 }
 
-func httpServer(h http.Handler, addr string) *http.Server {
+func httpServer(h http.Handler, addr string, tlsConfig *tls.Config) *http.Server {
 	httpServer := &http.Server{
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
+		TLSConfig:    tlsConfig,
 	}
 	httpServer.Addr = addr
 	httpServer.Handler = h
@@ -180,7 +424,13 @@ func httpServer(h http.Handler, addr string) *http.Server {
 }
 
 func mustListenAndServeHTTP(srv *http.Server) {
-	err := srv.ListenAndServe()
+	var err error
+	if srv.TLSConfig != nil {
+		// the certificate is provided by the tls config
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
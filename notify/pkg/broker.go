@@ -0,0 +1,291 @@
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// subscriberBuffer is the number of events a subscriber may fall behind before it is dropped.
+const subscriberBuffer = 256
+
+// dedupSize is the number of event ids remembered to drop duplicates.
+const dedupSize = 10000
+
+// Broker fans events out to subscribers.
+// It keeps the latest events so that subscribers can resume after reconnecting.
+type Broker struct {
+	mu          sync.Mutex
+	stream      string
+	sequence    uint64
+	subscribers map[*Subscription]struct{}
+	replay      *ring
+	journal     *journal
+	seen        *idSet
+	// Peers receive the events published locally, nil without replicas.
+	Peers *Peers
+	// Webhooks receive the events published locally, nil if there are no endpoints.
+	// Replicas receiving the forwarded events do not deliver them again.
+	Webhooks *Webhooks
+	// CoalesceWindow holds back the events published locally to merge repeated changes of an object,
+	// zero delivers them immediately.
+	CoalesceWindow time.Duration
+
+	batchMu sync.Mutex
+	batches map[string]*batch
+}
+
+// Subscription receives the events published after it was created.
+// Its channel is closed if the subscriber falls behind or is cancelled.
+type Subscription struct {
+	C <-chan *pb.Event
+
+	c      chan *pb.Event
+	broker *Broker
+}
+
+// NewBroker creates a broker keeping the last replaySize events in memory.
+func NewBroker(replaySize int) *Broker {
+	return &Broker{
+		stream: newEventID(),
+		// without persisted state sequence numbers start at the current time,
+		// so that they keep increasing across restarts and resuming clients detect the gap
+		sequence:    uint64(time.Now().UnixMicro()),
+		subscribers: map[*Subscription]struct{}{},
+		replay:      newRing(replaySize),
+		seen:        newIDSet(dedupSize),
+	}
+}
+
+// OpenBroker creates a broker which persists the replay buffer to a file.
+// Events of a previous run are restored from it.
+func OpenBroker(replaySize int, path string) (*Broker, error) {
+	b := NewBroker(replaySize)
+
+	j, events, err := openJournal(path, replaySize)
+	if err != nil {
+		return nil, err
+	}
+	b.journal = j
+
+	for _, e := range events {
+		b.replay.add(e)
+		if e.Id != "" {
+			b.seen.add(e.Id)
+		}
+		b.sequence = e.Sequence
+		b.stream = e.Stream
+	}
+
+	return b, nil
+}
+
+// Close delivers the events held back and closes the file persisting the events.
+func (b *Broker) Close() error {
+	b.Flush()
+
+	if b.journal == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.journal.close()
+}
+
+// Publish delivers an event received by this replica and forwards it to the peers and webhooks.
+// Events without id get a new one.
+// It returns the delivered event, nil if the event was a duplicate or is held back to be coalesced.
+func (b *Broker) Publish(e *pb.Event) *pb.Event {
+	e = proto.Clone(e).(*pb.Event)
+	if e.Id == "" {
+		e.Id = newEventID()
+	}
+
+	if b.CoalesceWindow > 0 && e.Key != "" {
+		b.coalesce(e)
+		return nil
+	}
+
+	return b.publish(e)
+}
+
+func (b *Broker) publish(e *pb.Event) *pb.Event {
+	e = b.deliver(e)
+	if e == nil {
+		return nil
+	}
+
+	if b.Peers != nil {
+		b.Peers.Forward(e)
+	}
+
+	if b.Webhooks != nil {
+		b.Webhooks.Send(e)
+	}
+
+	return e
+}
+
+// Deliver delivers an event forwarded by a peer.
+func (b *Broker) Deliver(e *pb.Event) *pb.Event {
+	return b.deliver(proto.Clone(e).(*pb.Event))
+}
+
+// deliver assigns the next sequence number to the event and sends it to all subscribers.
+// Subscribers which can not keep up are dropped instead of blocking the publisher.
+// Events seen before are dropped, nil is returned for them.
+func (b *Broker) deliver(e *pb.Event) *pb.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e.Id != "" && !b.seen.add(e.Id) {
+		return nil
+	}
+
+	b.sequence++
+	e.Sequence = b.sequence
+	e.Stream = b.stream
+
+	b.replay.add(e)
+	if b.journal != nil {
+		b.journal.append(e, b.replay)
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.c <- e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.c)
+		}
+	}
+
+	return e
+}
+
+// Subscribe registers a new subscriber, it needs to be cancelled once done.
+// If after is set, the events following it in the stream are returned to be delivered first.
+// If they are not available anymore a single gap event is returned instead.
+func (b *Broker) Subscribe(after uint64, stream string) (*Subscription, []*pb.Event) {
+	c := make(chan *pb.Event, subscriberBuffer)
+	sub := &Subscription{C: c, c: c, broker: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers[sub] = struct{}{}
+
+	if after == 0 || after == b.sequence && stream == b.stream {
+		return sub, nil
+	}
+
+	backlog, ok := b.replay.since(after)
+	if !ok || after > b.sequence || stream != b.stream {
+		return sub, []*pb.Event{{Sequence: b.sequence, Stream: b.stream, Gap: true}}
+	}
+
+	return sub, backlog
+}
+
+// Cancel unregisters the subscriber.
+func (s *Subscription) Cancel() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	if _, ok := s.broker.subscribers[s]; ok {
+		delete(s.broker.subscribers, s)
+		close(s.c)
+	}
+}
+
+// ring keeps the latest events.
+type ring struct {
+	events []*pb.Event
+	next   int
+	full   bool
+}
+
+func newRing(size int) *ring {
+	return &ring{events: make([]*pb.Event, size)}
+}
+
+func (r *ring) add(e *pb.Event) {
+	if len(r.events) == 0 {
+		return
+	}
+
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the events from oldest to newest.
+func (r *ring) all() []*pb.Event {
+	if !r.full {
+		return append([]*pb.Event{}, r.events[:r.next]...)
+	}
+
+	return append(append([]*pb.Event{}, r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// since returns the events following the sequence number,
+// it fails if some of them were dropped already.
+func (r *ring) since(after uint64) ([]*pb.Event, bool) {
+	events := r.all()
+	if len(events) == 0 || events[0].Sequence > after+1 {
+		return nil, false
+	}
+
+	for i, e := range events {
+		if e.Sequence > after {
+			return events[i:], true
+		}
+	}
+
+	return nil, true
+}
+
+// idSet remembers the latest ids.
+type idSet struct {
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newIDSet(size int) *idSet {
+	return &idSet{
+		ids:  map[string]struct{}{},
+		ring: make([]string, size),
+	}
+}
+
+// add reports if the id is new, the oldest id is forgotten.
+func (s *idSet) add(id string) bool {
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+
+	delete(s.ids, s.ring[s.next])
+	s.ring[s.next] = id
+	s.next = (s.next + 1) % len(s.ring)
+	s.ids[id] = struct{}{}
+
+	return true
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+
+	// crypto/rand does not fail on supported platforms
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
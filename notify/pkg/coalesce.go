@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+var eventsCoalesced = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "events_coalesced_total",
+		Help: "Count of events replaced by a later event of the same object before being delivered.",
+	},
+)
+
+// batch collects the events of a directory during the coalesce window.
+type batch struct {
+	timer *time.Timer
+	// keys in the order they changed first
+	keys   []string
+	events map[string]*pb.Event
+}
+
+// coalesce adds the event to the batch of its directory.
+// The first event of a batch starts the window, at its end the last event of every key is published.
+func (b *Broker) coalesce(e *pb.Event) {
+	prefix := e.Key[:strings.LastIndex(e.Key, "/")+1]
+
+	b.batchMu.Lock()
+	defer b.batchMu.Unlock()
+
+	if b.batches == nil {
+		b.batches = map[string]*batch{}
+	}
+
+	bt, ok := b.batches[prefix]
+	if !ok {
+		bt = &batch{events: map[string]*pb.Event{}}
+		bt.timer = time.AfterFunc(b.CoalesceWindow, func() { b.flush(prefix, bt) })
+		b.batches[prefix] = bt
+	}
+
+	if _, ok := bt.events[e.Key]; ok {
+		eventsCoalesced.Inc()
+	} else {
+		bt.keys = append(bt.keys, e.Key)
+	}
+	bt.events[e.Key] = e
+}
+
+// flush publishes the events of the batch unless it was flushed already.
+func (b *Broker) flush(prefix string, bt *batch) {
+	b.batchMu.Lock()
+	if b.batches[prefix] != bt {
+		b.batchMu.Unlock()
+		return
+	}
+	delete(b.batches, prefix)
+	b.batchMu.Unlock()
+
+	for _, key := range bt.keys {
+		b.publish(bt.events[key])
+	}
+}
+
+// Flush publishes all events held back.
+func (b *Broker) Flush() {
+	b.batchMu.Lock()
+	batches := b.batches
+	b.batches = nil
+	b.batchMu.Unlock()
+
+	for _, bt := range batches {
+		bt.timer.Stop()
+
+		for _, key := range bt.keys {
+			b.publish(bt.events[key])
+		}
+	}
+}
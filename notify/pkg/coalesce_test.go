@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+func TestBroker_coalesce(t *testing.T) {
+	b := NewBroker(0)
+	b.CoalesceWindow = 50 * time.Millisecond
+
+	sub, _ := b.Subscribe(0, "")
+	defer sub.Cancel()
+
+	published := []*pb.Event{
+		{Key: "files/docs/a.txt", Name: "s3:ObjectCreated:Put"},
+		{Key: "files/docs/b.txt", Name: "s3:ObjectCreated:Put"},
+		{Key: "files/docs/a.txt", Name: "s3:ObjectCreated:PutTagging"},
+		{Key: "files/other/a.txt", Name: "s3:ObjectCreated:Put"},
+		{Key: "files/docs/a.txt", Name: "s3:ObjectRemoved:Delete"},
+	}
+	for _, e := range published {
+		if b.Publish(e) != nil {
+			t.Errorf("event %s was not held back", e.Key)
+		}
+	}
+
+	select {
+	case e := <-sub.C:
+		t.Fatalf("event %s delivered before the window ended", e.Key)
+	default:
+	}
+
+	got := map[string]string{}
+	for len(got) < 3 {
+		select {
+		case e := <-sub.C:
+			if _, ok := got[e.Key]; ok {
+				t.Errorf("%s delivered twice", e.Key)
+			}
+			got[e.Key] = e.Name
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want three events", got)
+		}
+	}
+
+	want := map[string]string{
+		"files/docs/a.txt":  "s3:ObjectRemoved:Delete",
+		"files/docs/b.txt":  "s3:ObjectCreated:Put",
+		"files/other/a.txt": "s3:ObjectCreated:Put",
+	}
+	for key, name := range want {
+		if got[key] != name {
+			t.Errorf("%s: got %s, want %s", key, got[key], name)
+		}
+	}
+
+	// events held back are delivered on shutdown
+	b.Publish(&pb.Event{Key: "files/c.txt"})
+	b.Flush()
+
+	select {
+	case e := <-sub.C:
+		if e.Key != "files/c.txt" {
+			t.Errorf("flushed %s", e.Key)
+		}
+	default:
+		t.Errorf("flush did not deliver the event")
+	}
+}
@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+// DefaultEvents are the event name patterns changing the content of the bucket.
+var DefaultEvents = []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+
+// s3Notification is the payload of an s3 event notification.
+// MinIO adds EventName and Key of the first record, AWS only sends the records.
+type s3Notification struct {
+	EventName string
+	// Key is the bucket followed by the object key.
+	Key     string
+	Records []s3Record
+}
+
+type s3Record struct {
+	EventVersion string `json:"eventVersion"`
+	EventSource  string `json:"eventSource"`
+	AWSRegion    string `json:"awsRegion"`
+	EventTime    string `json:"eventTime"`
+	EventName    string `json:"eventName"`
+	UserIdentity struct {
+		PrincipalID string `json:"principalId"`
+	} `json:"userIdentity"`
+	RequestParameters map[string]string `json:"requestParameters"`
+	ResponseElements  map[string]string `json:"responseElements"`
+	S3                struct {
+		SchemaVersion   string `json:"s3SchemaVersion"`
+		ConfigurationID string `json:"configurationId"`
+		Bucket          struct {
+			Name          string `json:"name"`
+			OwnerIdentity struct {
+				PrincipalID string `json:"principalId"`
+			} `json:"ownerIdentity"`
+			ARN string `json:"arn"`
+		} `json:"bucket"`
+		Object struct {
+			// Key is url encoded.
+			Key          string            `json:"key"`
+			Size         int64             `json:"size"`
+			ETag         string            `json:"eTag"`
+			ContentType  string            `json:"contentType"`
+			UserMetadata map[string]string `json:"userMetadata"`
+			VersionID    string            `json:"versionId"`
+			Sequencer    string            `json:"sequencer"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// parseEvents returns an event for each record of the notification.
+func parseEvents(r io.Reader) ([]*pb.Event, error) {
+	n := &s3Notification{}
+
+	err := json.NewDecoder(r).Decode(n)
+	if err != nil {
+		return nil, fmt.Errorf("decode notification: %v", err)
+	}
+
+	if len(n.Records) == 0 {
+		if n.EventName == "" {
+			return nil, fmt.Errorf("notification without event")
+		}
+
+		e := &pb.Event{Name: n.EventName}
+		e.Bucket, e.Key, _ = strings.Cut(n.Key, "/")
+
+		return []*pb.Event{e}, nil
+	}
+
+	events := []*pb.Event{}
+	for i, record := range n.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("record %d: decode key %q: %v", i, record.S3.Object.Key, err)
+		}
+
+		name := record.EventName
+		// AWS omits the prefix
+		if !strings.HasPrefix(name, "s3:") {
+			name = "s3:" + name
+		}
+
+		events = append(events, &pb.Event{
+			Id:          recordID(record.S3.Bucket.Name, key, name, record.S3.Object.Sequencer, record.ResponseElements["x-amz-request-id"]),
+			Bucket:      record.S3.Bucket.Name,
+			Key:         key,
+			Name:        name,
+			Size:        record.S3.Object.Size,
+			Etag:        strings.Trim(record.S3.Object.ETag, `"`),
+			ContentType: record.S3.Object.ContentType,
+			VersionId:   record.S3.Object.VersionID,
+			Time:        record.EventTime,
+		})
+	}
+
+	return events, nil
+}
+
+// recordID derives the id of an event from its record, so that redelivered notifications are dropped as duplicates.
+// The sequencer orders the events of an object, the request id is used if it is missing.
+// Records with neither get no id and are never taken for duplicates.
+func recordID(bucket, key, name, sequencer, requestID string) string {
+	if sequencer == "" && requestID == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, s := range []string{bucket, key, name, sequencer, requestID} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// publishEvents publishes the events selected by the filter.
+func publishEvents(b *Broker, f *EventFilter, events []*pb.Event) {
+	for _, e := range events {
+		if !f.Matches(e.Name) {
+			continue
+		}
+
+		b.Publish(e)
+	}
+}
+
+// EventFilter selects events by name, patterns like s3:ObjectCreated:* are supported.
+type EventFilter struct {
+	patterns []string
+}
+
+// NewEventFilter validates the patterns.
+func NewEventFilter(patterns []string) (*EventFilter, error) {
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return nil, fmt.Errorf("event pattern %q: %v", p, err)
+		}
+	}
+
+	return &EventFilter{patterns: patterns}, nil
+}
+
+// Matches reports if the event name matches one of the patterns.
+func (f *EventFilter) Matches(name string) bool {
+	for _, p := range f.patterns {
+		// patterns are validated
+		ok, _ := path.Match(p, name)
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
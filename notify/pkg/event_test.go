@@ -0,0 +1,191 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+const minioMultipart = `{
+  "EventName": "s3:ObjectCreated:CompleteMultipartUpload",
+  "Key": "dinghy/files/my docs/report+final.pdf",
+  "Records": [{
+    "eventVersion": "2.0",
+    "eventSource": "minio:s3",
+    "awsRegion": "",
+    "eventTime": "2024-03-01T10:00:00.000Z",
+    "eventName": "s3:ObjectCreated:CompleteMultipartUpload",
+    "userIdentity": {"principalId": "minio"},
+    "requestParameters": {"sourceIPAddress": "10.0.0.1"},
+    "responseElements": {"x-amz-request-id": "17B8"},
+    "s3": {
+      "s3SchemaVersion": "1.0",
+      "configurationId": "Config",
+      "bucket": {"name": "dinghy", "ownerIdentity": {"principalId": "minio"}, "arn": "arn:aws:s3:::dinghy"},
+      "object": {
+        "key": "files%2Fmy+docs%2Freport%2Bfinal.pdf",
+        "size": 104857600,
+        "eTag": "\"9b2cf535f27731c974343645a3985328-20\"",
+        "contentType": "application/pdf",
+        "userMetadata": {"content-type": "application/pdf"},
+        "versionId": "1",
+        "sequencer": "17B8"
+      }
+    }
+  }]
+}`
+
+const awsBatch = `{"Records": [
+  {"eventTime": "2024-03-01T10:00:00Z", "eventName": "ObjectRemoved:DeleteMarkerCreated", "s3": {"bucket": {"name": "dinghy"}, "object": {"key": "files/a.txt", "versionId": "v2"}}},
+  {"eventTime": "2024-03-01T10:00:01Z", "eventName": "ObjectCreated:PutTagging", "s3": {"bucket": {"name": "dinghy"}, "object": {"key": "files/b.txt"}}}
+]}`
+
+func Test_parseEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []*pb.Event
+		wantErr bool
+	}{
+		{
+			name: "minio multipart upload",
+			body: minioMultipart,
+			want: []*pb.Event{{
+				Id:          recordID("dinghy", "files/my docs/report+final.pdf", "s3:ObjectCreated:CompleteMultipartUpload", "17B8", "17B8"),
+				Bucket:      "dinghy",
+				Key:         "files/my docs/report+final.pdf",
+				Name:        "s3:ObjectCreated:CompleteMultipartUpload",
+				Size:        104857600,
+				Etag:        "9b2cf535f27731c974343645a3985328-20",
+				ContentType: "application/pdf",
+				VersionId:   "1",
+				Time:        "2024-03-01T10:00:00.000Z",
+			}},
+		},
+		{
+			name: "aws batch",
+			body: awsBatch,
+			want: []*pb.Event{
+				{Bucket: "dinghy", Key: "files/a.txt", Name: "s3:ObjectRemoved:DeleteMarkerCreated", VersionId: "v2", Time: "2024-03-01T10:00:00Z"},
+				{Bucket: "dinghy", Key: "files/b.txt", Name: "s3:ObjectCreated:PutTagging", Time: "2024-03-01T10:00:01Z"},
+			},
+		},
+		{
+			name: "without records",
+			body: `{"EventName": "s3:ObjectRemoved:Delete", "Key": "dinghy/files/a.txt"}`,
+			want: []*pb.Event{{Bucket: "dinghy", Key: "files/a.txt", Name: "s3:ObjectRemoved:Delete"}},
+		},
+		{
+			name:    "invalid key encoding",
+			body:    `{"Records": [{"eventName": "s3:ObjectCreated:Put", "s3": {"object": {"key": "files%zz"}}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no event",
+			body:    `{}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseEvents(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEvents() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("parseEvents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseEvents_redelivered(t *testing.T) {
+	b := NewBroker(10)
+
+	for i, want := range []bool{true, false} {
+		events, err := parseEvents(strings.NewReader(minioMultipart))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if events[0].Id == "" {
+			t.Fatal("event without id")
+		}
+
+		if got := b.Publish(events[0]) != nil; got != want {
+			t.Errorf("delivery %d published = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestEventFilter_Matches(t *testing.T) {
+	f, err := NewEventFilter(DefaultEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"s3:ObjectCreated:Put", true},
+		{"s3:ObjectCreated:CompleteMultipartUpload", true},
+		{"s3:ObjectCreated:PutRetention", true},
+		{"s3:ObjectRemoved:DeleteMarkerCreated", true},
+		{"s3:ObjectAccessed:Get", false},
+		{"s3:BucketCreated", false},
+	}
+	for _, tt := range tests {
+		if got := f.Matches(tt.name); got != tt.want {
+			t.Errorf("Matches(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	_, err = NewEventFilter([]string{"s3:Object[Created"})
+	if err == nil {
+		t.Errorf("NewEventFilter() accepted an invalid pattern")
+	}
+}
+
+func TestServer_webhook_records(t *testing.T) {
+	s := NewServer()
+	s.Broker = NewBroker(0)
+
+	sub, _ := s.Broker.Subscribe(0, "")
+	defer sub.Cancel()
+
+	body := strings.Replace(awsBatch, "]}", `, {"eventName": "ObjectAccessed:Get", "s3": {"object": {"key": "files/c.txt"}}}]}`, 1)
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("webhook code = %v", w.Code)
+	}
+
+	keys := []string{}
+	for len(keys) < 2 {
+		select {
+		case e := <-sub.C:
+			keys = append(keys, e.Key)
+		case <-time.After(time.Second):
+			t.Fatalf("received %v, want two events", keys)
+		}
+	}
+
+	select {
+	case e := <-sub.C:
+		t.Errorf("filtered event was published: %v", e)
+	default:
+	}
+
+	if !reflect.DeepEqual(keys, []string{"files/a.txt", "files/b.txt"}) {
+		t.Errorf("published %v", keys)
+	}
+}
@@ -5,28 +5,81 @@
 package notify
 
 import (
-	"sync"
-
 	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type GRPCServer struct {
-	C *sync.Cond
+	Broker *Broker
 }
 
+// Listen returns with the next event or when the call is cancelled.
 func (s *GRPCServer) Listen(ctx context.Context, in *pb.Request) (*pb.Response, error) {
-	s.C.L.Lock()
-	s.C.Wait()
-	s.C.L.Unlock()
+	sub, _ := s.Broker.Subscribe(0, "")
+	defer sub.Cancel()
 
-	return &pb.Response{}, nil
+	select {
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	case <-sub.C:
+		return &pb.Response{}, nil
+	}
 }
 
+// Notify publishes the event of the request.
+// Events forwarded by peers are only delivered to the local subscribers.
 func (s *GRPCServer) Notify(ctx context.Context, in *pb.Request) (*pb.Response, error) {
-	s.C.L.Lock()
-	s.C.Broadcast()
-	s.C.L.Unlock()
+	e := in.GetEvent()
+	if e == nil {
+		e = &pb.Event{}
+	}
+
+	if in.GetForwarded() {
+		s.Broker.Deliver(e)
+	} else {
+		s.Broker.Publish(e)
+	}
 
 	return &pb.Response{}, nil
 }
+
+// Subscribe streams events until the call is cancelled.
+// Resuming subscribers first receive the events they missed or a gap event.
+func (s *GRPCServer) Subscribe(in *pb.SubscribeRequest, stream pb.Notifier_SubscribeServer) error {
+	sub, backlog := s.Broker.Subscribe(in.GetAfter(), in.GetStream())
+	defer sub.Cancel()
+
+	// tells the client that the subscription is established before the first event
+	err := stream.SendHeader(metadata.MD{})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range backlog {
+		err := stream.Send(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := stream.Context()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case e, ok := <-sub.C:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "subscriber fell behind, resubscribe and relist")
+			}
+
+			err := stream.Send(e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func testClient(t *testing.T, s *GRPCServer) pb.NotifierClient {
+	l := bufconn.Listen(1 << 20)
+
+	srv := grpc.NewServer()
+	pb.RegisterNotifierServer(srv, s)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewNotifierClient(conn)
+}
+
+// subscribers waits until the broker has n subscribers.
+func subscribers(t *testing.T, b *Broker, n int) {
+	for i := 0; i < 100; i++ {
+		b.mu.Lock()
+		got := len(b.subscribers)
+		b.mu.Unlock()
+
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("broker did not reach %d subscribers", n)
+}
+
+func TestGRPCServer_Subscribe(t *testing.T) {
+	s := &GRPCServer{Broker: NewBroker(16)}
+	c := testClient(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Subscribe(ctx, &pb.SubscribeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscribers(t, s.Broker, 1)
+
+	keys := []string{"files/a.txt", "files/b.txt"}
+	for _, key := range keys {
+		_, err := c.Notify(ctx, &pb.Request{Event: &pb.Event{Bucket: "dinghy", Key: key, Name: "s3:ObjectCreated:Put", Size: 3}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := uint64(0)
+	for i, key := range keys {
+		e, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 0 {
+			first = e.Sequence
+		}
+
+		if e.Key != key || e.Sequence != first+uint64(i) || e.Size != 3 {
+			t.Errorf("event %d = %v, want key %s and sequence %d", i, e, key, first+uint64(i))
+		}
+	}
+
+	cancel()
+
+	_, err = stream.Recv()
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("Recv() after cancel = %v, want canceled", err)
+	}
+	subscribers(t, s.Broker, 0)
+}
+
+func TestGRPCServer_Listen_cancel(t *testing.T) {
+	s := &GRPCServer{Broker: NewBroker(16)}
+	c := testClient(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := c.Listen(ctx, &pb.Request{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Listen() = %v, want deadline exceeded", err)
+	}
+	subscribers(t, s.Broker, 0)
+}
+
+func TestBroker_slowSubscriber(t *testing.T) {
+	b := NewBroker(16)
+	sub, _ := b.Subscribe(0, "")
+	defer sub.Cancel()
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		b.Publish(&pb.Event{})
+	}
+
+	n := 0
+	for range sub.C {
+		n++
+	}
+
+	if n != subscriberBuffer {
+		t.Errorf("received %d events before being dropped, want %d", n, subscriberBuffer)
+	}
+}
+
+func TestBroker_Subscribe_resume(t *testing.T) {
+	b := NewBroker(3)
+
+	published := []*pb.Event{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		published = append(published, b.Publish(&pb.Event{Key: key}))
+	}
+	last := published[3].Sequence
+	stream := published[3].Stream
+
+	tests := []struct {
+		name     string
+		after    uint64
+		stream   string
+		wantKeys []string
+		wantGap  bool
+	}{
+		{"new subscriber", 0, "", nil, false},
+		{"up to date", last, stream, nil, false},
+		{"missed two", published[1].Sequence, stream, []string{"c", "d"}, false},
+		{"oldest kept event is next", published[0].Sequence, stream, []string{"b", "c", "d"}, false},
+		{"buffer exceeded", published[0].Sequence - 1, stream, nil, true},
+		{"unknown future sequence", last + 1, stream, nil, true},
+		{"stream of another replica", published[1].Sequence, "other", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, backlog := b.Subscribe(tt.after, tt.stream)
+			defer sub.Cancel()
+
+			if tt.wantGap {
+				if len(backlog) != 1 || !backlog[0].Gap || backlog[0].Sequence != last {
+					t.Errorf("Subscribe(%d) = %v, want gap at %d", tt.after, backlog, last)
+				}
+				return
+			}
+
+			keys := []string{}
+			for _, e := range backlog {
+				keys = append(keys, e.Key)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(tt.wantKeys) {
+				t.Errorf("Subscribe(%d) replayed %v, want %v", tt.after, keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestOpenBroker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	b, err := OpenBroker(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough events to compact the journal
+	var e *pb.Event
+	for i := 0; i < 7; i++ {
+		e = b.Publish(&pb.Event{Key: fmt.Sprintf("files/%d.txt", i)})
+	}
+	b.Close()
+
+	b, err = OpenBroker(2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	_, backlog := b.Subscribe(e.Sequence-2, e.Stream)
+	if len(backlog) != 2 || backlog[1].Sequence != e.Sequence || backlog[1].Key != "files/6.txt" {
+		t.Errorf("restored backlog = %v, want the last two events", backlog)
+	}
+
+	next := b.Publish(&pb.Event{})
+	if next.Sequence != e.Sequence+1 {
+		t.Errorf("sequence after restore = %d, want %d", next.Sequence, e.Sequence+1)
+	}
+}
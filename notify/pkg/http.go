@@ -1,27 +1,34 @@
 package notify
 
 import (
-	"encoding/json"
-	"fmt"
+	"bytes"
 	"io"
 	"log"
 	"net/http"
 	"net/http/pprof"
-	"sync"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// maxWebhookBody limits the size of notifications.
+const maxWebhookBody = 1 << 20
+
 // Server handles http requests.
 type Server struct {
-	BearerToken string
-	router      *http.ServeMux
-	C           *sync.Cond
+	// Tokens are the accepted bearer tokens, nil disables the check.
+	Tokens *WebhookTokens
+	// HMACKey requires requests to be signed if set.
+	HMACKey []byte
+	// Events selects the events which are published.
+	Events *EventFilter
+	router *http.ServeMux
+	Broker *Broker
 }
 
 // NewServer creates a new http server.
 func NewServer() *Server {
 	srv := &Server{}
+	srv.Events, _ = NewEventFilter(DefaultEvents)
 	srv.routes()
 
 	return srv
@@ -44,54 +51,32 @@ func (s *Server) routes() {
 
 func (s *Server) webhook() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !s.isValidMinioRequest(r) {
-			return
-		}
-
-		t, err := eventType(r.Body)
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
 		if err != nil {
-			log.Printf("get event type: %v", err)
+			log.Printf("read webhook: %v", err)
 			w.WriteHeader(http.StatusBadRequest)
 
 			return
 		}
 
-		if !meansChange(t) {
+		reason := s.authenticate(r, body)
+		if reason != "" {
+			log.Printf("webhook rejected: %s", reason)
+			webhookRejected.WithLabelValues(reason).Inc()
+			w.Header().Set("WWW-Authenticate", `Bearer realm="notify"`)
+			w.WriteHeader(http.StatusUnauthorized)
+
 			return
 		}
 
-		s.C.L.Lock()
-		s.C.Broadcast()
-		s.C.L.Unlock()
-	}
-}
-
-func (s *Server) isValidMinioRequest(r *http.Request) bool {
-	return r.Header.Get("Authorization") == "Bearer "+s.BearerToken
-}
-
-type minioNotification struct {
-	EventName string
-}
-
-func eventType(r io.Reader) (string, error) {
-	notification := &minioNotification{}
-
-	err := json.NewDecoder(r).Decode(notification)
-	if err != nil {
-		return "", fmt.Errorf("get event type: %v", err)
-	}
-
-	return notification.EventName, nil
-}
+		events, err := parseEvents(bytes.NewReader(body))
+		if err != nil {
+			log.Printf("parse events: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
 
-func meansChange(event string) bool {
-	ss := []string{"s3:ObjectRemoved:Delete", "s3:ObjectCreated:Put", "s3:ObjectCreated:Copy"}
-	for _, s := range ss {
-		if event == s {
-			return true
+			return
 		}
-	}
 
-	return false
+		publishEvents(s.Broker, s.Events, events)
+	}
 }
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_webhook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+
+	err := os.WriteFile(path, []byte("# rotated on monday\nold-token\nnew-token\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := LoadWebhookTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := []byte("hmac-key")
+	body := `{"EventName": "s3:ObjectCreated:Put"}`
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		hmacKey   []byte
+		token     string
+		signature string
+		wantCode  int
+	}{
+		{"old token", nil, "old-token", "", http.StatusOK},
+		{"new token", nil, "new-token", "", http.StatusOK},
+		{"missing token", nil, "", "", http.StatusUnauthorized},
+		{"wrong token", nil, "new-tokeN", "", http.StatusUnauthorized},
+		{"comment is no token", nil, "# rotated on monday", "", http.StatusUnauthorized},
+		{"signed", key, "new-token", signature, http.StatusOK},
+		{"unsigned", key, "new-token", "", http.StatusUnauthorized},
+		{"wrong signature", key, "new-token", "sha256=" + strings.Repeat("0", 64), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer()
+			s.Tokens = tokens
+			s.HMACKey = tt.hmacKey
+			s.Broker = NewBroker(0)
+
+			r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.signature != "" {
+				r.Header.Set(signatureHeader, tt.signature)
+			}
+			w := httptest.NewRecorder()
+
+			s.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("webhook code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWebhookTokens_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+
+	err := os.WriteFile(path, []byte("first\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := LoadWebhookTokens(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("second\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := tokens.reload()
+	if err != nil || !changed {
+		t.Fatalf("reload() = %v, %v", changed, err)
+	}
+
+	if tokens.valid("first") || !tokens.valid("second") {
+		t.Errorf("reload() did not replace the tokens")
+	}
+
+	err = os.WriteFile(path, []byte("# all removed\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.reload()
+	if err == nil || !tokens.valid("second") {
+		t.Errorf("reload() of empty file = %v, want error and previous tokens kept", err)
+	}
+}
@@ -0,0 +1,145 @@
+package notify
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// journal appends events as json lines to a file.
+// It is rewritten with the replay buffer once it holds twice as many events.
+type journal struct {
+	path  string
+	f     *os.File
+	lines int
+	limit int
+}
+
+// openJournal opens the journal and returns the latest size events stored in it.
+func openJournal(path string, size int) (*journal, []*pb.Event, error) {
+	events, err := readJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+
+	j := &journal{path: path, limit: 2 * size}
+
+	err = j.rewrite(events)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return j, events, nil
+}
+
+func readJournal(path string) ([]*pb.Event, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open journal %s: %v", path, err)
+	}
+	defer f.Close()
+
+	events := []*pb.Event{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := &pb.Event{}
+
+		err := protojson.Unmarshal(scanner.Bytes(), e)
+		if err != nil {
+			// the last line may be incomplete after a crash
+			log.Printf("journal %s: skip line %d: %v", path, len(events)+1, err)
+			continue
+		}
+
+		events = append(events, e)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("read journal %s: %v", path, err)
+	}
+
+	return events, nil
+}
+
+// append writes the event, the replay buffer replaces the file content once it grew too large.
+func (j *journal) append(e *pb.Event, replay *ring) {
+	if j.lines >= j.limit {
+		err := j.rewrite(replay.all())
+		if err != nil {
+			log.Printf("compact journal: %v", err)
+		}
+		return
+	}
+
+	b, err := protojson.Marshal(e)
+	if err != nil {
+		log.Printf("journal event %d: %v", e.Sequence, err)
+		return
+	}
+
+	_, err = j.f.Write(append(b, '\n'))
+	if err != nil {
+		log.Printf("journal event %d: %v", e.Sequence, err)
+		return
+	}
+
+	j.lines++
+}
+
+// rewrite replaces the file by one containing the events.
+func (j *journal) rewrite(events []*pb.Event) error {
+	tmp := j.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create journal %s: %v", tmp, err)
+	}
+
+	w := bufio.NewWriter(f)
+	for _, e := range events {
+		b, err := protojson.Marshal(e)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("journal event %d: %v", e.Sequence, err)
+		}
+
+		_, _ = w.Write(append(b, '\n'))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("write journal %s: %v", tmp, err)
+	}
+
+	err = os.Rename(tmp, j.path)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("replace journal %s: %v", j.path, err)
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	j.lines = len(events)
+
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
@@ -0,0 +1,15 @@
+package notify
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// RegisterMetrics registers the metrics of the notify service.
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{webhookRejected, peerForwarded, outboundDeliveries, outboundDuration, natsMessages, eventsCoalesced} {
+		err := r.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
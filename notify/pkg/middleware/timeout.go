@@ -10,7 +10,7 @@ import (
 func Timeout(timeout time.Duration, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		if IsWebsocket(r) {
+		if IsWebsocket(r) || IsEventStream(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -37,5 +37,12 @@ func Timeout(timeout time.Duration, next http.Handler) http.Handler {
 }
 
 func IsWebsocket(r *http.Request) bool {
-	return strings.Contains(r.Header.Get("Connection"), "Upgrade") && r.Header.Get("Upgrade") == "websocket"
+	connection := strings.ToLower(r.Header.Get("Connection"))
+	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
+	return strings.Contains(connection, "upgrade") && upgrade == "websocket"
+}
+
+// IsEventStream reports if the client requests server-sent events.
+func IsEventStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
 }
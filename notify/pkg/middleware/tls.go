@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval limits how often certificate files are checked for changes.
+const reloadInterval = 10 * time.Second
+
+// fileWatch tells if files changed since they were read last.
+type fileWatch struct {
+	files   []string
+	checked time.Time
+	modTime []time.Time
+}
+
+// changed checks the modification times at most every reloadInterval.
+func (w *fileWatch) changed(now time.Time) bool {
+	if now.Sub(w.checked) < reloadInterval {
+		return false
+	}
+	w.checked = now
+
+	modTime := make([]time.Time, len(w.files))
+	for i, f := range w.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			log.Printf("stat %s: %v", f, err)
+			return false
+		}
+		modTime[i] = info.ModTime()
+	}
+
+	changed := false
+	for i := range modTime {
+		if i >= len(w.modTime) || !modTime[i].Equal(w.modTime[i]) {
+			changed = true
+		}
+	}
+	w.modTime = modTime
+
+	return changed
+}
+
+// Certificate is a key pair which is reloaded when its files change.
+type Certificate struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.Mutex
+	watch fileWatch
+	cert  *tls.Certificate
+}
+
+// LoadCertificate reads a pem encoded certificate and key.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+		watch:    fileWatch{files: []string{certFile, keyFile}},
+	}
+
+	c.watch.changed(time.Now())
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair %s %s: %v", certFile, keyFile, err)
+	}
+	c.cert = &cert
+
+	return c, nil
+}
+
+func (c *Certificate) current() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.watch.changed(time.Now()) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			// the files may be replaced one after the other, keep the previous pair meanwhile
+			log.Printf("reload key pair %s %s: %v", c.certFile, c.keyFile, err)
+			c.watch.modTime = nil
+		} else {
+			log.Printf("reloaded key pair %s", c.certFile)
+			c.cert = &cert
+		}
+	}
+
+	return c.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (c *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current(), nil
+}
+
+// CertPool is a set of pem encoded CA certificates which is reloaded when its file changes.
+type CertPool struct {
+	file string
+
+	mu    sync.Mutex
+	watch fileWatch
+	pool  *x509.CertPool
+}
+
+// LoadCertPool reads pem encoded CA certificates.
+func LoadCertPool(file string) (*CertPool, error) {
+	p := &CertPool{
+		file:  file,
+		watch: fileWatch{files: []string{file}},
+	}
+
+	p.watch.changed(time.Now())
+
+	pool, err := readCertPool(file)
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+
+	return p, nil
+}
+
+func readCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read CA %s: %v", file, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("CA %s contains no certificate", file)
+	}
+
+	return pool, nil
+}
+
+func (p *CertPool) current() *x509.CertPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.watch.changed(time.Now()) {
+		pool, err := readCertPool(p.file)
+		if err != nil {
+			log.Printf("reload %v", err)
+			p.watch.modTime = nil
+		} else {
+			log.Printf("reloaded CA %s", p.file)
+			p.pool = pool
+		}
+	}
+
+	return p.pool
+}
+
+// verify checks the certificate chain presented by a peer.
+// The server name, a host name or an ip address, is only checked if it is not empty.
+func (p *CertPool) verify(certs []*x509.Certificate, serverName string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         p.current(),
+		Intermediates: intermediates,
+		DNSName:       serverName,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+
+	return err
+}
+
+// ServerTLSConfig creates the configuration of a listener.
+// If clientCA is set clients need to present a certificate signed by it.
+func ServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+
+	if clientCA == "" {
+		return cfg, nil
+	}
+
+	pool, err := LoadCertPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	// the chain is verified below against the current pool to pick up CA changes
+	cfg.ClientAuth = tls.RequireAnyClientCert
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := pool.verify(cs.PeerCertificates, "", x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return fmt.Errorf("verify client certificate: %v", err)
+		}
+		return nil
+	}
+
+	return cfg, nil
+}
+
+// ClientTLSConfig creates the configuration to dial a server.
+// Without ca the system roots are trusted, certFile and keyFile are presented if set.
+// With ca the server name is required, it is the name or ip address expected in the server certificate.
+func ClientTLSConfig(ca, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := LoadCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = cert.GetClientCertificate
+	}
+
+	if ca == "" {
+		return cfg, nil
+	}
+
+	if serverName == "" {
+		return nil, fmt.Errorf("server name required to verify certificates signed by %s", ca)
+	}
+
+	pool, err := LoadCertPool(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	// the default verification only knows a static pool, it is replaced by one against the current pool.
+	// The configured name is checked, the connection state lacks it when dialing an ip address.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		err := pool.verify(cs.PeerCertificates, serverName, x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return fmt.Errorf("verify server certificate: %v", err)
+		}
+		return nil
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,290 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+
+	return &testCA{cert: cert, key: key, dir: dir}
+}
+
+// issue writes a key pair signed by the CA and returns the paths of certificate and key.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.DNSNames = nil
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client to a server on a loopback listener.
+func handshake(t *testing.T, server, client *tls.Config) error {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer c.Close()
+		errs <- c.(*tls.Conn).Handshake()
+	}()
+
+	c, err := tls.Dial("tcp", l.Addr().String(), client)
+	if err != nil {
+		<-errs
+		return err
+	}
+	defer c.Close()
+
+	// with TLS 1.3 the client learns about a rejected certificate only on its first read
+	return <-errs
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t, dir, "ca")
+	foreign := newTestCA(t, dir, "foreign")
+
+	serverCert, serverKey := ca.issue(t, "notify", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, "backend", x509.ExtKeyUsageClientAuth)
+	foreignCert, foreignKey := foreign.issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+
+	server, err := ServerTLSConfig(serverCert, serverKey, filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		ca         string
+		cert       string
+		key        string
+		serverName string
+		wantErr    bool
+	}{
+		{
+			name:       "valid client certificate",
+			ca:         "ca.pem",
+			cert:       clientCert,
+			key:        clientKey,
+			serverName: "notify",
+		},
+		{
+			name:       "no client certificate",
+			ca:         "ca.pem",
+			serverName: "notify",
+			wantErr:    true,
+		},
+		{
+			name:       "client certificate of a foreign CA",
+			ca:         "ca.pem",
+			cert:       foreignCert,
+			key:        foreignKey,
+			serverName: "notify",
+			wantErr:    true,
+		},
+		{
+			name:       "server certificate of an untrusted CA",
+			ca:         "foreign.pem",
+			cert:       clientCert,
+			key:        clientKey,
+			serverName: "notify",
+			wantErr:    true,
+		},
+		{
+			name:       "server name mismatch",
+			ca:         "ca.pem",
+			cert:       clientCert,
+			key:        clientKey,
+			serverName: "backend",
+			wantErr:    true,
+		},
+		{
+			name:       "ip address missing in server certificate",
+			ca:         "ca.pem",
+			cert:       clientCert,
+			key:        clientKey,
+			serverName: "127.0.0.1",
+			wantErr:    true,
+		},
+		{
+			name:    "server name missing",
+			ca:      "ca.pem",
+			cert:    clientCert,
+			key:     clientKey,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := ClientTLSConfig(filepath.Join(dir, tt.ca), tt.cert, tt.key, tt.serverName)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			err = handshake(t, server, client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientTLSConfig_ipAddress(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+
+	server, err := ServerTLSConfig(serverCert, serverKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{serverName: "127.0.0.1"},
+		{serverName: "127.0.0.2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			client, err := ClientTLSConfig(filepath.Join(dir, "ca.pem"), "", "", tt.serverName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = handshake(t, server, client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertificate_reload(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCA(t, dir, "ca")
+	certFile, keyFile := ca.issue(t, "notify", x509.ExtKeyUsageServerAuth)
+
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.current()
+
+	// a broken pair keeps the previous certificate
+	err = os.WriteFile(keyFile, []byte("broken"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.watch.checked = time.Time{}
+	c.watch.modTime = nil
+
+	if c.current() != first {
+		t.Errorf("broken key pair replaced the certificate")
+	}
+
+	ca.issue(t, "notify", x509.ExtKeyUsageServerAuth)
+	c.watch.checked = time.Time{}
+
+	if c.current() == first {
+		t.Errorf("renewed key pair was not loaded")
+	}
+}
@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var natsMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "nats_messages_total",
+		Help: "Count of bucket notifications received from nats by result.",
+	},
+	[]string{"result"},
+)
+
+// NATSConsumer publishes the bucket events MinIO sends to a nats subject,
+// like the webhook does for notifications sent by http.
+type NATSConsumer struct {
+	Broker *Broker
+	// Events selects the events which are published.
+	Events *EventFilter
+	// Queue is the queue group shared by the replicas, so every notification is published once.
+	Queue string
+	// JetStream consumes from a stream with the durable consumer Durable,
+	// so notifications sent while notify is down are delivered afterwards.
+	JetStream bool
+	Durable   string
+}
+
+// Subscribe starts consuming the notifications sent to subject.
+func (c *NATSConsumer) Subscribe(nc *nats.Conn, subject string) (*nats.Subscription, error) {
+	if !c.JetStream {
+		sub, err := nc.QueueSubscribe(subject, c.Queue, c.handle)
+		if err != nil {
+			return nil, fmt.Errorf("subscribe %s: %v", subject, err)
+		}
+
+		return sub, nil
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("jetstream: %v", err)
+	}
+
+	sub, err := js.QueueSubscribe(subject, c.Queue, c.handle, nats.Durable(c.Durable), nats.ManualAck())
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s with consumer %s: %v", subject, c.Durable, err)
+	}
+
+	return sub, nil
+}
+
+func (c *NATSConsumer) handle(msg *nats.Msg) {
+	events, err := parseEvents(bytes.NewReader(msg.Data))
+	if err != nil {
+		log.Printf("parse nats notification: %v", err)
+		natsMessages.WithLabelValues("invalid").Inc()
+
+		// redelivering does not help
+		if c.JetStream {
+			err = msg.Term()
+			if err != nil {
+				log.Printf("terminate nats notification: %v", err)
+			}
+		}
+
+		return
+	}
+
+	publishEvents(c.Broker, c.Events, events)
+	natsMessages.WithLabelValues("ok").Inc()
+
+	if c.JetStream {
+		err = msg.Ack()
+		if err != nil {
+			log.Printf("ack nats notification: %v", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func natsServer(t *testing.T) *nats.Conn {
+	s, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		NoLog:     true,
+		NoSigs:    true,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+	t.Cleanup(s.Shutdown)
+
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	return nc
+}
+
+func TestNATSConsumer_Subscribe(t *testing.T) {
+	tests := []struct {
+		name      string
+		jetStream bool
+	}{
+		{name: "core"},
+		{name: "jetstream", jetStream: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := natsServer(t)
+
+			b := NewBroker(0)
+			sub, _ := b.Subscribe(0, "")
+			defer sub.Cancel()
+
+			c := &NATSConsumer{Broker: b, Queue: "notify", JetStream: tt.jetStream, Durable: "notify"}
+			c.Events, _ = NewEventFilter(DefaultEvents)
+
+			if tt.jetStream {
+				js, err := nc.JetStream()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, err = js.AddStream(&nats.StreamConfig{Name: "events", Subjects: []string{"bucketevents"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// sent while notify is not subscribed
+				_, err = js.Publish("bucketevents", []byte(awsBatch))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			natsSub, err := c.Subscribe(nc, "bucketevents")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer natsSub.Unsubscribe()
+
+			if !tt.jetStream {
+				err = nc.Publish("bucketevents", []byte(awsBatch))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = nc.Publish("bucketevents", []byte("invalid"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys := []string{}
+			for len(keys) < 2 {
+				select {
+				case e := <-sub.C:
+					keys = append(keys, e.Key)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("received %v, want two events", keys)
+				}
+			}
+
+			if keys[0] != "files/a.txt" || keys[1] != "files/b.txt" {
+				t.Errorf("published %v", keys)
+			}
+
+			if !tt.jetStream {
+				return
+			}
+
+			// acknowledged notifications are not delivered again
+			time.Sleep(100 * time.Millisecond)
+
+			info, err := natsSub.ConsumerInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.NumAckPending != 0 || info.NumPending != 0 {
+				t.Errorf("pending %d, ack pending %d", info.NumPending, info.NumAckPending)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+const (
+	// outboundQueue is the number of events waiting to be delivered to a single endpoint.
+	outboundQueue = 1000
+	// outboundAttempts is the default number of tries to deliver an event.
+	outboundAttempts = 6
+	outboundTimeout  = 10 * time.Second
+	outboundMaxDelay = 5 * time.Minute
+	// timestampHeader carries the unix time of the delivery attempt, it is covered by the signature
+	// so that receivers can reject replayed calls.
+	timestampHeader = "X-Signature-Timestamp"
+)
+
+var (
+	outboundDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbound_webhook_deliveries_total",
+			Help: "Count of outbound webhook calls by endpoint and result.",
+		},
+		[]string{"endpoint", "result"},
+	)
+	outboundDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "outbound_webhook_duration_seconds",
+			Help: "Duration of outbound webhook calls.",
+		},
+		[]string{"endpoint"},
+	)
+)
+
+// WebhookEndpoint receives the events matching its filters.
+type WebhookEndpoint struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Prefix of the object keys, like files/projects/.
+	Prefix string `json:"prefix,omitempty"`
+	// Events are event name patterns, all events are sent if empty.
+	Events []string `json:"events,omitempty"`
+	// Secret signs the timestamp and the payload in the X-Signature-256 header, SecretFile reads it from a file.
+	Secret      string `json:"secret,omitempty"`
+	SecretFile  string `json:"secretFile,omitempty"`
+	MaxAttempts int    `json:"maxAttempts,omitempty"`
+}
+
+// LoadWebhookEndpoints reads the endpoints from a json file.
+func LoadWebhookEndpoints(path string) ([]WebhookEndpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read webhook endpoints %s: %v", path, err)
+	}
+
+	endpoints := []WebhookEndpoint{}
+
+	err = json.Unmarshal(b, &endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("parse webhook endpoints %s: %v", path, err)
+	}
+
+	names := map[string]bool{}
+	for i, e := range endpoints {
+		if e.Name == "" || e.URL == "" {
+			return nil, fmt.Errorf("webhook endpoint %d: name and url are required", i)
+		}
+
+		if names[e.Name] {
+			return nil, fmt.Errorf("webhook endpoint %s: duplicate name", e.Name)
+		}
+		names[e.Name] = true
+
+		if e.SecretFile != "" {
+			secret, err := os.ReadFile(e.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("webhook endpoint %s: read secret: %v", e.Name, err)
+			}
+			endpoints[i].Secret = string(bytes.TrimSpace(secret))
+		}
+	}
+
+	return endpoints, nil
+}
+
+// outboundEvent is the payload sent to endpoints.
+type outboundEvent struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	VersionID   string `json:"versionId,omitempty"`
+	Time        string `json:"time,omitempty"`
+}
+
+func newOutboundEvent(e *pb.Event) outboundEvent {
+	return outboundEvent{
+		ID:          e.Id,
+		Name:        e.Name,
+		Bucket:      e.Bucket,
+		Key:         e.Key,
+		Size:        e.Size,
+		ETag:        e.Etag,
+		ContentType: e.ContentType,
+		VersionID:   e.VersionId,
+		Time:        e.Time,
+	}
+}
+
+// deadLetter records an event which could not be delivered.
+type deadLetter struct {
+	Time     time.Time     `json:"time"`
+	Endpoint string        `json:"endpoint"`
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error"`
+	Event    outboundEvent `json:"event"`
+}
+
+// Webhooks delivers events to the configured endpoints.
+// Each endpoint has its own queue, so a failing endpoint does not delay the others.
+type Webhooks struct {
+	client *http.Client
+	// retryDelay is the delay before the first retry, it doubles with every attempt.
+	retryDelay time.Duration
+
+	mu         sync.Mutex
+	deadLetter io.Writer
+
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	targets []*webhookTarget
+}
+
+type webhookTarget struct {
+	WebhookEndpoint
+	filter *EventFilter
+	events chan *pb.Event
+}
+
+// NewWebhooks starts delivering to the endpoints.
+// Undeliverable events are written as json lines to deadLetter.
+func NewWebhooks(endpoints []WebhookEndpoint, deadLetter io.Writer) (*Webhooks, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &Webhooks{
+		client:     &http.Client{Timeout: outboundTimeout},
+		retryDelay: time.Second,
+		deadLetter: deadLetter,
+		cancel:     cancel,
+	}
+
+	for _, e := range endpoints {
+		t := &webhookTarget{
+			WebhookEndpoint: e,
+			events:          make(chan *pb.Event, outboundQueue),
+		}
+
+		if t.MaxAttempts < 1 {
+			t.MaxAttempts = outboundAttempts
+		}
+
+		if len(e.Events) > 0 {
+			f, err := NewEventFilter(e.Events)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("webhook endpoint %s: %v", e.Name, err)
+			}
+			t.filter = f
+		}
+
+		w.targets = append(w.targets, t)
+	}
+
+	for _, t := range w.targets {
+		w.wg.Add(1)
+		go w.run(ctx, t)
+	}
+
+	return w, nil
+}
+
+// Send queues the event for all matching endpoints without blocking.
+func (w *Webhooks) Send(e *pb.Event) {
+	for _, t := range w.targets {
+		if !t.matches(e) {
+			continue
+		}
+
+		select {
+		case t.events <- e:
+		default:
+			outboundDeliveries.WithLabelValues(t.Name, "dropped").Inc()
+			w.dead(t, e, 0, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+// Close stops the delivery, queued events are written to the dead letter log.
+func (w *Webhooks) Close() {
+	w.cancel()
+	w.wg.Wait()
+
+	for _, t := range w.targets {
+		for len(t.events) > 0 {
+			w.dead(t, <-t.events, 0, fmt.Errorf("shutdown"))
+		}
+	}
+}
+
+func (t *webhookTarget) matches(e *pb.Event) bool {
+	return strings.HasPrefix(e.Key, t.Prefix) && (t.filter == nil || t.filter.Matches(e.Name))
+}
+
+func (w *Webhooks) run(ctx context.Context, t *webhookTarget) {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-t.events:
+			attempts, err := w.deliver(ctx, t, e)
+			if err != nil {
+				outboundDeliveries.WithLabelValues(t.Name, "failed").Inc()
+				w.dead(t, e, attempts, err)
+				continue
+			}
+
+			outboundDeliveries.WithLabelValues(t.Name, "ok").Inc()
+		}
+	}
+}
+
+// deliver posts the event, retrying with exponentially increasing delays.
+func (w *Webhooks) deliver(ctx context.Context, t *webhookTarget, e *pb.Event) (int, error) {
+	body, err := json.Marshal(newOutboundEvent(e))
+	if err != nil {
+		return 0, fmt.Errorf("encode event: %v", err)
+	}
+
+	delay := w.retryDelay
+
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, t, e, body)
+		if err == nil {
+			return attempt, nil
+		}
+
+		if !retry || attempt >= t.MaxAttempts {
+			return attempt, err
+		}
+
+		outboundDeliveries.WithLabelValues(t.Name, "retry").Inc()
+		log.Printf("deliver event %s to %s, attempt %d: %v", e.Id, t.Name, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > outboundMaxDelay {
+			delay = outboundMaxDelay
+		}
+	}
+}
+
+// post sends the payload once and reports if a failure is worth retrying.
+func (w *Webhooks) post(ctx context.Context, t *webhookTarget, e *pb.Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", e.Id)
+	req.Header.Set("X-Event-Name", e.Name)
+
+	if t.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(signatureHeader, "sha256="+outboundSignature(t.Secret, timestamp, body))
+	}
+
+	start := time.Now()
+	resp, err := w.client.Do(req)
+	outboundDuration.WithLabelValues(t.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// allow the connection to be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("status %s", resp.Status)
+	}
+}
+
+// outboundSignature is the hex encoded HMAC-SHA256 of the timestamp, a dot and the body.
+func outboundSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhooks) dead(t *webhookTarget, e *pb.Event, attempts int, err error) {
+	b, merr := json.Marshal(deadLetter{
+		Time:     time.Now().UTC(),
+		Endpoint: t.Name,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Event:    newOutboundEvent(e),
+	})
+	if merr != nil {
+		log.Printf("encode dead letter: %v", merr)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, werr := w.deadLetter.Write(append(b, '\n'))
+	if werr != nil {
+		log.Printf("write dead letter %s: %v", b, werr)
+	}
+}
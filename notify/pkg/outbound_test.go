@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWebhooks(t *testing.T) {
+	mu := sync.Mutex{}
+	received := map[string][]outboundEvent{}
+	failures := 2
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/flaky":
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			timestamp, err := strconv.ParseInt(r.Header.Get(timestampHeader), 10, 64)
+			if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write([]byte(r.Header.Get(timestampHeader) + "."))
+			mac.Write(body)
+			if r.Header.Get(signatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case "/rejecting":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		e := outboundEvent{}
+		_ = json.Unmarshal(body, &e)
+		received[r.URL.Path] = append(received[r.URL.Path], e)
+	}))
+	defer srv.Close()
+
+	deadLetter := &syncBuffer{}
+
+	w, err := NewWebhooks([]WebhookEndpoint{
+		{Name: "flaky", URL: srv.URL + "/flaky", Secret: "secret"},
+		{Name: "projects", URL: srv.URL + "/projects", Prefix: "files/projects/", Events: []string{"s3:ObjectCreated:*"}},
+		{Name: "rejecting", URL: srv.URL + "/rejecting", Prefix: "files/projects/"},
+	}, deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.retryDelay = time.Millisecond
+
+	w.Send(&pb.Event{Id: "1", Key: "files/projects/a.txt", Name: "s3:ObjectCreated:Put"})
+	w.Send(&pb.Event{Id: "2", Key: "files/projects/a.txt", Name: "s3:ObjectRemoved:Delete"})
+	w.Send(&pb.Event{Id: "3", Key: "files/b.txt", Name: "s3:ObjectCreated:Put"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		done := len(received["/flaky"]) == 3 && len(received["/projects"]) == 1
+		mu.Unlock()
+
+		if done && strings.Count(deadLetter.String(), "\n") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v, dead letters %s", received, deadLetter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w.Close()
+
+	if received["/projects"][0].ID != "1" {
+		t.Errorf("projects received %v, want event 1", received["/projects"])
+	}
+
+	for i, e := range received["/flaky"] {
+		if e.ID != []string{"1", "2", "3"}[i] {
+			t.Errorf("flaky received %v, want all events in order", received["/flaky"])
+		}
+	}
+
+	if !strings.Contains(deadLetter.String(), `"endpoint":"rejecting","attempts":1`) {
+		t.Errorf("dead letters = %s, want rejected events without retry", deadLetter)
+	}
+}
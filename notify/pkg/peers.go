@@ -0,0 +1,237 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+const (
+	// peerQueue is the number of events waiting to be forwarded to a single peer.
+	peerQueue = 1000
+	// peerAttempts is the number of tries to forward an event.
+	peerAttempts = 5
+	peerTimeout  = 5 * time.Second
+)
+
+var peerForwarded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "peer_events_forwarded_total",
+		Help: "Count of events forwarded to notify replicas by result.",
+	},
+	[]string{"result"},
+)
+
+// Dialer connects to the notify service at addr.
+type Dialer func(addr string) (pb.NotifierClient, io.Closer, error)
+
+// Peers forwards the events received by this replica to the other replicas.
+type Peers struct {
+	dial Dialer
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+type peer struct {
+	addr   string
+	client pb.NotifierClient
+	conn   io.Closer
+	events chan *pb.Event
+	cancel context.CancelFunc
+}
+
+// NewPeers creates an empty set of peers.
+func NewPeers(dial Dialer) *Peers {
+	return &Peers{
+		dial:  dial,
+		peers: map[string]*peer{},
+	}
+}
+
+// Set replaces the peers by the replicas at addrs.
+func (p *Peers) Set(addrs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keep := map[string]bool{}
+	for _, addr := range addrs {
+		keep[addr] = true
+
+		if _, ok := p.peers[addr]; ok {
+			continue
+		}
+
+		client, conn, err := p.dial(addr)
+		if err != nil {
+			log.Printf("connect to peer %s: %v", addr, err)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		pr := &peer{
+			addr:   addr,
+			client: client,
+			conn:   conn,
+			events: make(chan *pb.Event, peerQueue),
+			cancel: cancel,
+		}
+		p.peers[addr] = pr
+
+		log.Printf("forwarding events to peer %s", addr)
+		go pr.run(ctx)
+	}
+
+	for addr, pr := range p.peers {
+		if !keep[addr] {
+			log.Printf("stop forwarding events to peer %s", addr)
+			pr.stop()
+			delete(p.peers, addr)
+		}
+	}
+}
+
+// Forward queues the event for all peers without blocking.
+func (p *Peers) Forward(e *pb.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pr := range p.peers {
+		select {
+		case pr.events <- e:
+		default:
+			log.Printf("forward event %s to peer %s: queue full", e.Id, pr.addr)
+			peerForwarded.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// Close stops forwarding.
+func (p *Peers) Close() {
+	p.Set(nil)
+}
+
+// Discover resolves the host of addr every interval and forwards to all of its addresses
+// except the ones of this replica.
+func (p *Peers) Discover(ctx context.Context, addr string, interval time.Duration) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Printf("discover peers %s: %v", addr, err)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			log.Printf("discover peers %s: %v", host, err)
+		} else {
+			p.Set(peerAddrs(ips, port, localIPs()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// peerAddrs joins the ips with the port, skipping the local ones.
+func peerAddrs(ips []string, port string, local map[string]bool) []string {
+	addrs := []string{}
+
+	for _, ip := range ips {
+		if local[ip] {
+			continue
+		}
+
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+func localIPs() map[string]bool {
+	ips := map[string]bool{}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("list interface addresses: %v", err)
+		return ips
+	}
+
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			ips[n.IP.String()] = true
+		}
+	}
+
+	return ips
+}
+
+func (pr *peer) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-pr.events:
+			err := pr.forward(ctx, e)
+			if err != nil {
+				log.Printf("forward event %s to peer %s: %v", e.Id, pr.addr, err)
+				peerForwarded.WithLabelValues("failed").Inc()
+				continue
+			}
+
+			peerForwarded.WithLabelValues("ok").Inc()
+		}
+	}
+}
+
+// forward sends the event, retrying with increasing delays.
+// Peers drop duplicates, so an event may be sent again if the response was lost.
+func (pr *peer) forward(ctx context.Context, e *pb.Event) error {
+	delay := 100 * time.Millisecond
+
+	var err error
+	for i := 0; i < peerAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		callCtx, cancel := context.WithTimeout(ctx, peerTimeout)
+		_, err = pr.client.Notify(callCtx, &pb.Request{Event: e, Forwarded: true})
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (pr *peer) stop() {
+	pr.cancel()
+
+	err := pr.conn.Close()
+	if err != nil {
+		log.Printf("close connection to peer %s: %v", pr.addr, err)
+	}
+}
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"gitlab.com/davedamoon/dinghy/notify/pkg/pb"
+)
+
+func TestPeers_Forward(t *testing.T) {
+	a := &GRPCServer{Broker: NewBroker(16)}
+	b := &GRPCServer{Broker: NewBroker(16)}
+
+	clients := map[string]pb.NotifierClient{
+		"a:50051": testClient(t, a),
+		"b:50051": testClient(t, b),
+	}
+	dial := func(addr string) (pb.NotifierClient, io.Closer, error) {
+		return clients[addr], io.NopCloser(nil), nil
+	}
+
+	// both replicas forward to each other
+	a.Broker.Peers = NewPeers(dial)
+	a.Broker.Peers.Set([]string{"b:50051"})
+	defer a.Broker.Peers.Close()
+
+	b.Broker.Peers = NewPeers(dial)
+	b.Broker.Peers.Set([]string{"a:50051"})
+	defer b.Broker.Peers.Close()
+
+	subA, _ := a.Broker.Subscribe(0, "")
+	defer subA.Cancel()
+	subB, _ := b.Broker.Subscribe(0, "")
+	defer subB.Cancel()
+
+	e := a.Broker.Publish(&pb.Event{Key: "files/a.txt"})
+
+	for name, sub := range map[string]*Subscription{"a": subA, "b": subB} {
+		select {
+		case got := <-sub.C:
+			if got.Id != e.Id || got.Key != e.Key {
+				t.Errorf("replica %s received %v, want %v", name, got, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("replica %s did not receive the event", name)
+		}
+	}
+
+	// a retried forward is dropped
+	if b.Broker.Deliver(e) != nil {
+		t.Errorf("duplicate event was delivered")
+	}
+
+	select {
+	case got := <-subA.C:
+		t.Errorf("replica a received its forwarded event back: %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_peerAddrs(t *testing.T) {
+	got := peerAddrs([]string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "fd00::1"}, "50051", map[string]bool{"10.0.0.2": true})
+	want := []string{"10.0.0.1:50051", "10.0.0.3:50051", "[fd00::1]:50051"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("peerAddrs() = %v, want %v", got, want)
+	}
+}
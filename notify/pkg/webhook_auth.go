@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// signatureHeader carries the hex encoded HMAC-SHA256 of the request body.
+const signatureHeader = "X-Signature-256"
+
+var webhookRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_rejected_total",
+		Help: "Count of webhook calls rejected by authentication.",
+	},
+	[]string{"reason"},
+)
+
+// WebhookTokens are the bearer tokens accepted by the webhook.
+// Multiple tokens allow rotation, the file is reloaded when it changes.
+type WebhookTokens struct {
+	path string
+
+	mu      sync.RWMutex
+	tokens  [][]byte
+	modTime time.Time
+}
+
+// LoadWebhookTokens reads a file with one token per line, lines starting with # are ignored.
+func LoadWebhookTokens(path string) (*WebhookTokens, error) {
+	t := &WebhookTokens{path: path}
+
+	_, err := t.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// reload reads the token file if it changed since the last read.
+func (t *WebhookTokens) reload() (bool, error) {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false, fmt.Errorf("stat webhook tokens %s: %v", t.path, err)
+	}
+
+	t.mu.RLock()
+	unchanged := info.ModTime().Equal(t.modTime)
+	t.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := os.ReadFile(t.path)
+	if err != nil {
+		return false, fmt.Errorf("read webhook tokens %s: %v", t.path, err)
+	}
+
+	tokens := parseWebhookTokens(b)
+	if len(tokens) == 0 {
+		return false, fmt.Errorf("webhook tokens %s: no token found", t.path)
+	}
+
+	t.mu.Lock()
+	t.tokens = tokens
+	t.modTime = info.ModTime()
+	t.mu.Unlock()
+
+	return true, nil
+}
+
+func parseWebhookTokens(b []byte) [][]byte {
+	tokens := [][]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens = append(tokens, []byte(line))
+	}
+
+	return tokens
+}
+
+// Watch reloads the token file every interval until the context ends.
+// The previous tokens stay active if the file can not be read.
+func (t *WebhookTokens) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := t.reload()
+			if err != nil {
+				log.Printf("reload webhook tokens: %v", err)
+				continue
+			}
+
+			if changed {
+				log.Printf("reloaded webhook tokens from %s", t.path)
+			}
+		}
+	}
+}
+
+// valid compares the token with all active tokens in constant time.
+func (t *WebhookTokens) valid(token string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	match := 0
+	for _, candidate := range t.tokens {
+		match |= subtle.ConstantTimeCompare([]byte(token), candidate)
+	}
+
+	return match == 1
+}
+
+// authenticate checks the bearer token and the signature of the body.
+// It returns the reason of the rejection, empty if the request is valid.
+func (s *Server) authenticate(r *http.Request, body []byte) string {
+	if s.Tokens != nil {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return "missing_token"
+		}
+
+		if !s.Tokens.valid(strings.TrimPrefix(auth, "Bearer ")) {
+			return "invalid_token"
+		}
+	}
+
+	if len(s.HMACKey) > 0 {
+		signature := r.Header.Get(signatureHeader)
+		if !strings.HasPrefix(signature, "sha256=") {
+			return "missing_signature"
+		}
+
+		got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+		if err != nil {
+			return "invalid_signature"
+		}
+
+		mac := hmac.New(sha256.New, s.HMACKey)
+		mac.Write(body)
+
+		if !hmac.Equal(got, mac.Sum(nil)) {
+			return "invalid_signature"
+		}
+	}
+
+	return ""
+}